@@ -3,12 +3,13 @@
 package headscale
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -16,53 +17,171 @@ import (
 type HeadscaleClient interface {
 	GetNode(ctx context.Context, nodeId string) (*Node, error)
 	ListNodes(ctx context.Context, userFilter string) ([]Node, error)
+	ListNodesByTag(ctx context.Context, tag string) ([]Node, error)
 	Health(ctx context.Context) (*HealthResponse, error)
 	CreateUser(ctx context.Context, req *CreateUserRequest) (*User, error)
+	CreatePreAuthKey(ctx context.Context, user string, tags []string, expiry time.Time) (*PreAuthKey, error)
+	SetNodeTags(ctx context.Context, nodeId string, tags []string) error
 }
 
 // Client represents a client for the Headscale API.
+//
+// Every request goes through doWithRetry/doCachedGET (resilience.go), which
+// retries 5xx/429/network errors with backoff and jitter, coalesces repeated
+// GETs through respCache, and fast-fails via breaker once Headscale looks
+// unhealthy. RetryMax, cache TTLs and the breaker threshold are all
+// Corefile-configurable; see setup.go's headscale_retry/headscale_cache/
+// headscale_breaker directives.
 type Client struct {
 	BaseURL    string
 	APIKey     string
 	HTTPClient *http.Client
+
+	RetryMax       int
+	RetryBaseDelay time.Duration
+
+	cache   *respCache
+	breaker *breaker
 }
 
-// NewClient creates a new Headscale API client.
-func NewClient(baseURL, apiKey string) *Client {
+// NewClient creates a new Headscale API client with the default retry,
+// cache and circuit breaker settings. baseURL is validated and normalized
+// (see normalizeBaseURL) so that an IPv6 literal host is bracketed before
+// it's ever concatenated into a request URL.
+func NewClient(baseURL, apiKey string) (*Client, error) {
+	normalized, err := normalizeBaseURL(baseURL)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Client{
-		BaseURL: baseURL,
+		BaseURL: normalized,
 		APIKey:  apiKey,
 		HTTPClient: &http.Client{
 			Timeout: 30 * time.Second,
 		},
+		RetryMax:       defaultRetryMax,
+		RetryBaseDelay: defaultRetryBaseDelay,
+		cache:          newRespCache(defaultPositiveCacheTTL, defaultNegativeCacheTTL),
+		breaker:        newBreaker(normalized, defaultBreakerThreshold, defaultBreakerCooldown),
+	}, nil
+}
+
+// normalizeBaseURL parses and validates a Headscale base URL, bracketing a
+// bare IPv6 host (e.g. "http://fd7a::1:8080") so the colons in the literal
+// aren't misread as a port separator, then returns the parsed form with any
+// trailing slash removed.
+func normalizeBaseURL(raw string) (string, error) {
+	parsed, err := url.Parse(raw)
+	// A bare IPv6 literal (e.g. "http://fd7a::1:8080") parses "successfully"
+	// in current Go, just with an unbracketed Host ("fd7a::1:8080") whose
+	// colons leave the port ambiguous, so the bracketing repair has to run on
+	// the host's shape, not on a parse failure that will never actually occur
+	// for this input.
+	if bracketed, ok := bracketIPv6Host(raw); ok {
+		parsed, err = url.Parse(bracketed)
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid Headscale base URL %q: %w", raw, err)
+	}
+	if parsed.Host == "" {
+		return "", fmt.Errorf("invalid Headscale base URL %q: missing host", raw)
+	}
+
+	parsed.Path = strings.TrimSuffix(parsed.Path, "/")
+	return parsed.String(), nil
+}
+
+// bracketIPv6Host rewrites "scheme://fd7a::1:8080/path" into
+// "scheme://[fd7a::1]:8080/path" when the authority looks like a bare IPv6
+// literal (two or more colons before the path), which url.Parse otherwise
+// accepts as one unbracketed host. It reports false if raw doesn't look like
+// that shape, leaving the caller with its original parse result.
+func bracketIPv6Host(raw string) (string, bool) {
+	schemeSep := strings.Index(raw, "://")
+	if schemeSep == -1 {
+		return "", false
+	}
+	scheme, rest := raw[:schemeSep+3], raw[schemeSep+3:]
+
+	authority, path := rest, ""
+	if i := strings.IndexByte(rest, '/'); i != -1 {
+		authority, path = rest[:i], rest[i:]
+	}
+	if strings.HasPrefix(authority, "[") || strings.Count(authority, ":") < 2 {
+		return "", false
 	}
+
+	// A trailing ":<digits>" is only a port if what's left still looks like
+	// a full IPv6 literal (i.e. still has the "::" or equivalent double
+	// colon a minimal address needs) — otherwise "fd7a::1" would have its
+	// final hextet "1" misread as a port, leaving the bogus host "fd7a:".
+	host, port := authority, ""
+	if i := strings.LastIndex(authority, ":"); i != -1 {
+		if _, err := strconv.Atoi(authority[i+1:]); err == nil && strings.Count(authority[:i], ":") >= 2 {
+			host, port = authority[:i], authority[i:]
+		}
+	}
+
+	return scheme + "[" + host + "]" + port + path, true
+}
+
+// SetCacheTTLs overrides the positive/negative response cache TTLs.
+func (c *Client) SetCacheTTLs(positive, negative time.Duration) {
+	c.cache = newRespCache(positive, negative)
+}
+
+// SetBreakerThreshold overrides the consecutive-failure count that trips the
+// circuit breaker, and how long it stays open before the next call is let
+// through to probe recovery.
+func (c *Client) SetBreakerThreshold(threshold int, cooldown time.Duration) {
+	c.breaker = newBreaker(c.BaseURL, threshold, cooldown)
 }
 
 // Node represents a node in the Headscale network.
 type Node struct {
-	ID           string    `json:"id"`
-	MachineKey   string    `json:"machineKey"`
-	NodeKey      string    `json:"nodeKey"`
-	DiscoKey     string    `json:"discoKey"`
-	IPAddresses  []string  `json:"ipAddresses"`
-	Name         string    `json:"name"`
-	User         User      `json:"user"`
-	LastSeen     time.Time `json:"lastSeen"`
-	Expiry       time.Time `json:"expiry"`
-	CreatedAt    time.Time `json:"createdAt"`
-	RegisterMethod string  `json:"registerMethod"`
-	Online       bool      `json:"online"`
-	ApprovedRoutes []string `json:"approvedRoutes"`
-	AvailableRoutes []string `json:"availableRoutes"`
+	ID              string    `json:"id"`
+	MachineKey      string    `json:"machineKey"`
+	NodeKey         string    `json:"nodeKey"`
+	DiscoKey        string    `json:"discoKey"`
+	IPAddresses     []string  `json:"ipAddresses"`
+	Name            string    `json:"name"`
+	User            User      `json:"user"`
+	LastSeen        time.Time `json:"lastSeen"`
+	Expiry          time.Time `json:"expiry"`
+	CreatedAt       time.Time `json:"createdAt"`
+	RegisterMethod  string    `json:"registerMethod"`
+	Online          bool      `json:"online"`
+	ApprovedRoutes  []string  `json:"approvedRoutes"`
+	AvailableRoutes []string  `json:"availableRoutes"`
+	ForcedTags      []string  `json:"forcedTags"`
+	ValidTags       []string  `json:"validTags"`
+}
+
+// HasTag reports whether tag appears in either the node's forced or valid
+// tag set. Forced tags are server-assigned and cannot be removed by the
+// node owner, so service identity should always be checked against both.
+func (n Node) HasTag(tag string) bool {
+	for _, t := range n.ForcedTags {
+		if t == tag {
+			return true
+		}
+	}
+	for _, t := range n.ValidTags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
 }
 
 // User represents a user in the Headscale system.
 type User struct {
-	ID          string `json:"id"`
-	Name        string `json:"name"`
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
 	CreatedAt   time.Time `json:"createdAt"`
-	DisplayName string `json:"displayName"`
-	Email       string `json:"email"`
+	DisplayName string    `json:"displayName"`
+	Email       string    `json:"email"`
 }
 
 // ListNodesResponse represents the response from the ListNodes API endpoint.
@@ -78,101 +197,79 @@ type GetNodeResponse struct {
 // GetNode retrieves a specific node by ID from Headscale.
 func (c *Client) GetNode(ctx context.Context, nodeId string) (*Node, error) {
 	url := fmt.Sprintf("%s/api/v1/node/%s", c.BaseURL, nodeId)
-	
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-	
-	req.Header.Set("Authorization", "Bearer "+c.APIKey)
-	
-	resp, err := c.HTTPClient.Do(req)
+
+	body, err := c.doCachedGET(ctx, url)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
-	}
-	
+
 	var getResp GetNodeResponse
-	if err := json.NewDecoder(resp.Body).Decode(&getResp); err != nil {
+	if err := json.Unmarshal(body, &getResp); err != nil {
 		return nil, err
 	}
-	
+
 	return &getResp.Node, nil
 }
 
 // ListNodes retrieves all nodes from Headscale.
 func (c *Client) ListNodes(ctx context.Context, userFilter string) ([]Node, error) {
 	url := fmt.Sprintf("%s/api/v1/node", c.BaseURL)
-	
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-	
 	if userFilter != "" {
-		q := req.URL.Query()
-		q.Add("user", userFilter)
-		req.URL.RawQuery = q.Encode()
-	}
-	
-	req.Header.Set("Authorization", "Bearer "+c.APIKey)
-	
-	resp, err := c.HTTPClient.Do(req)
+		url += "?user=" + userFilter
+	}
+
+	body, err := c.doCachedGET(ctx, url)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
-	}
-	
+
 	var listResp ListNodesResponse
-	if err := json.NewDecoder(resp.Body).Decode(&listResp); err != nil {
+	if err := json.Unmarshal(body, &listResp); err != nil {
 		return nil, err
 	}
-	
+
 	return listResp.Nodes, nil
 }
 
+// ListNodesByTag returns the nodes carrying tag in either their forced or
+// valid tag set. Headscale has no server-side tag filter, so filtering
+// happens locally over the (cached) ListNodes result.
+func (c *Client) ListNodesByTag(ctx context.Context, tag string) ([]Node, error) {
+	nodes, err := c.ListNodes(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []Node
+	for _, node := range nodes {
+		if node.HasTag(tag) {
+			matching = append(matching, node)
+		}
+	}
+	return matching, nil
+}
+
 // HealthResponse represents the response from the health API endpoint.
 type HealthResponse struct {
 	DatabaseConnectivity bool `json:"databaseConnectivity"`
 }
 
-// Health checks the health status of the Headscale server.
+// Health checks the health status of the Headscale server. It bypasses the
+// response cache and the circuit breaker: it is the recovery probe other
+// callers are fast-failing behind, so it always has to actually ask.
 func (c *Client) Health(ctx context.Context) (*HealthResponse, error) {
 	url := fmt.Sprintf("%s/api/v1/health", c.BaseURL)
-	
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-	
-	req.Header.Set("Authorization", "Bearer "+c.APIKey)
-	
-	resp, err := c.HTTPClient.Do(req)
+
+	body, err := c.doWithRetryUngated(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("health check failed with status %d: %s", resp.StatusCode, string(body))
+		return nil, fmt.Errorf("health check failed: %w", err)
 	}
-	
+
 	var healthResp HealthResponse
-	if err := json.NewDecoder(resp.Body).Decode(&healthResp); err != nil {
+	if err := json.Unmarshal(body, &healthResp); err != nil {
 		return nil, err
 	}
-	
+
 	return &healthResp, nil
 }
 
@@ -191,35 +288,92 @@ type CreateUserResponse struct {
 // CreateUser creates a new user in Headscale.
 func (c *Client) CreateUser(ctx context.Context, req *CreateUserRequest) (*User, error) {
 	url := fmt.Sprintf("%s/api/v1/user", c.BaseURL)
-	
+
 	jsonData, err := json.Marshal(req)
 	if err != nil {
 		return nil, err
 	}
-	
-	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
+
+	body, err := c.doWithRetry(ctx, http.MethodPost, url, jsonData)
 	if err != nil {
+		return nil, fmt.Errorf("create user failed: %w", err)
+	}
+
+	var createUserResp CreateUserResponse
+	if err := json.Unmarshal(body, &createUserResp); err != nil {
 		return nil, err
 	}
-	
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("Authorization", "Bearer "+c.APIKey)
-	
-	resp, err := c.HTTPClient.Do(httpReq)
+
+	return &createUserResp.User, nil
+}
+
+// PreAuthKey represents a pre-authentication key that lets a node join
+// Headscale directly under a user with a fixed set of tags.
+type PreAuthKey struct {
+	Key        string    `json:"key"`
+	User       string    `json:"user"`
+	Tags       []string  `json:"aclTags"`
+	Reusable   bool      `json:"reusable"`
+	Ephemeral  bool      `json:"ephemeral"`
+	Expiration time.Time `json:"expiration"`
+}
+
+// CreatePreAuthKeyRequest represents the request for creating a pre-auth key.
+type CreatePreAuthKeyRequest struct {
+	User       string    `json:"user"`
+	ACLTags    []string  `json:"aclTags"`
+	Expiration time.Time `json:"expiration"`
+}
+
+// CreatePreAuthKeyResponse represents the response from the
+// CreatePreAuthKey API endpoint.
+type CreatePreAuthKeyResponse struct {
+	PreAuthKey PreAuthKey `json:"preAuthKey"`
+}
+
+// CreatePreAuthKey provisions a per-service join key for user, tagged with
+// tags so the node it authenticates carries the right service identity as
+// soon as it registers.
+func (c *Client) CreatePreAuthKey(ctx context.Context, user string, tags []string, expiry time.Time) (*PreAuthKey, error) {
+	url := fmt.Sprintf("%s/api/v1/preauthkey", c.BaseURL)
+
+	jsonData, err := json.Marshal(CreatePreAuthKeyRequest{User: user, ACLTags: tags, Expiration: expiry})
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("create user failed with status %d: %s", resp.StatusCode, string(body))
+
+	body, err := c.doWithRetry(ctx, http.MethodPost, url, jsonData)
+	if err != nil {
+		return nil, fmt.Errorf("create pre-auth key failed: %w", err)
 	}
-	
-	var createUserResp CreateUserResponse
-	if err := json.NewDecoder(resp.Body).Decode(&createUserResp); err != nil {
+
+	var createResp CreatePreAuthKeyResponse
+	if err := json.Unmarshal(body, &createResp); err != nil {
 		return nil, err
 	}
-	
-	return &createUserResp.User, nil
-}
\ No newline at end of file
+
+	return &createResp.PreAuthKey, nil
+}
+
+// SetNodeTagsRequest represents the request for setting a node's forced tags.
+type SetNodeTagsRequest struct {
+	Tags []string `json:"tags"`
+}
+
+// SetNodeTags overwrites the forced tags of nodeId. The reconcile loop uses
+// this to bring a node's tags in line with the ServiceExports it should
+// advertise.
+func (c *Client) SetNodeTags(ctx context.Context, nodeId string, tags []string) error {
+	url := fmt.Sprintf("%s/api/v1/node/%s/tags", c.BaseURL, nodeId)
+
+	jsonData, err := json.Marshal(SetNodeTagsRequest{Tags: tags})
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.doWithRetry(ctx, http.MethodPost, url, jsonData); err != nil {
+		return fmt.Errorf("set node tags failed: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,41 @@
+package headscale
+
+import "testing"
+
+// TestNormalizeBaseURL covers plain hostnames, already-bracketed IPv6
+// literals, bare IPv6 literals that need bracketing, and trailing slashes.
+func TestNormalizeBaseURL(t *testing.T) {
+	cases := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{name: "hostname", in: "https://headscale.example.com", want: "https://headscale.example.com"},
+		{name: "hostname with trailing slash", in: "https://headscale.example.com/", want: "https://headscale.example.com"},
+		{name: "already bracketed IPv6", in: "http://[fd7a::1]:8080", want: "http://[fd7a::1]:8080"},
+		{name: "bare IPv6 literal", in: "http://fd7a::1:8080", want: "http://[fd7a::1]:8080"},
+		{name: "bare IPv6 literal with path", in: "http://fd7a::1:8080/api", want: "http://[fd7a::1]:8080/api"},
+		{name: "bare IPv6 literal without port", in: "http://fd7a::1", want: "http://[fd7a::1]"},
+		{name: "bare IPv6 literal without port with path", in: "http://fd7a::1/api", want: "http://[fd7a::1]/api"},
+		{name: "missing scheme", in: "headscale.example.com", wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := normalizeBaseURL(tc.in)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("normalizeBaseURL(%q) = %q, want %q", tc.in, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package headscale
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// circuitBreakerOpen reports, per Client, whether that client is currently
+// fast-failing requests because Headscale has been unhealthy. It sits
+// alongside k8s_cross's own request_count_total metric so operators can
+// correlate DNS errors with Headscale outages.
+var circuitBreakerOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "coredns",
+	Subsystem: "headscale_client",
+	Name:      "circuit_breaker_open",
+	Help:      "1 if the Headscale client's circuit breaker is open (fast-failing), 0 otherwise.",
+}, []string{"base_url"})
+
+// defaultRetryMax, defaultRetryBaseDelay, defaultBreakerThreshold and the
+// cache TTLs below are NewClient's defaults; all are overridable per Client
+// via Corefile options (see setup.go).
+const (
+	defaultRetryMax         = 3
+	defaultRetryBaseDelay   = 200 * time.Millisecond
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+	defaultPositiveCacheTTL = 5 * time.Second
+	defaultNegativeCacheTTL = 1 * time.Second
+)
+
+// breaker is a simple consecutive-failure circuit breaker: it opens for
+// cooldown once threshold consecutive failures are recorded, and resets as
+// soon as a call succeeds (in practice, a Health() probe during the outage).
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	baseURL   string
+}
+
+func newBreaker(baseURL string, threshold int, cooldown time.Duration) *breaker {
+	return &breaker{threshold: threshold, cooldown: cooldown, baseURL: baseURL}
+}
+
+// isOpen reports whether calls should currently fast-fail.
+func (b *breaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Now().Before(b.openUntil)
+}
+
+func (b *breaker) recordSuccess() {
+	b.mu.Lock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+	b.mu.Unlock()
+	circuitBreakerOpen.WithLabelValues(b.baseURL).Set(0)
+}
+
+func (b *breaker) recordFailure() {
+	b.mu.Lock()
+	b.failures++
+	tripped := b.failures >= b.threshold
+	if tripped {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+	b.mu.Unlock()
+	if tripped {
+		circuitBreakerOpen.WithLabelValues(b.baseURL).Set(1)
+	}
+}
+
+// cacheEntry is one coalesced response: either a successful body or the
+// error returned for a request that failed.
+type cacheEntry struct {
+	body      []byte
+	err       error
+	expiresAt time.Time
+}
+
+// respCache caches GET responses (keyed by url) for a configurable TTL, so
+// repeated identical DNS queries within that TTL produce one upstream
+// Headscale call. Identical requests that arrive before the first response
+// is stored are not merged; each of them reaches Headscale. Failures are
+// cached too, for a shorter TTL, so queries during an outage don't retry
+// Headscale on every query once a failure is stored.
+type respCache struct {
+	mu          sync.Mutex
+	entries     map[string]cacheEntry
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+}
+
+func newRespCache(positiveTTL, negativeTTL time.Duration) *respCache {
+	return &respCache{
+		entries:     make(map[string]cacheEntry),
+		positiveTTL: positiveTTL,
+		negativeTTL: negativeTTL,
+	}
+}
+
+func (c *respCache) get(key string) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expiresAt) {
+		return cacheEntry{}, false
+	}
+	return e, true
+}
+
+func (c *respCache) put(key string, body []byte, err error) {
+	ttl := c.positiveTTL
+	if err != nil {
+		ttl = c.negativeTTL
+	}
+	c.mu.Lock()
+	c.entries[key] = cacheEntry{body: body, err: err, expiresAt: time.Now().Add(ttl)}
+	c.mu.Unlock()
+}
+
+// doCachedGET issues a GET to url, or serves a response respCache stored
+// for url within its TTL, and returns the body bytes. Concurrent identical
+// requests that all miss the cache each issue their own GET.
+func (c *Client) doCachedGET(ctx context.Context, url string) ([]byte, error) {
+	if entry, ok := c.cache.get(url); ok {
+		return entry.body, entry.err
+	}
+
+	body, err := c.doWithRetry(ctx, http.MethodGet, url, nil)
+	c.cache.put(url, body, err)
+	return body, err
+}
+
+// doWithRetry issues one HTTP request, retrying on network errors, 429s and
+// 5xx responses with exponential backoff and jitter (honoring Retry-After
+// when the server sends one), and fast-fails while the circuit breaker is
+// open. It does not itself interpret the response body; callers decode it.
+func (c *Client) doWithRetry(ctx context.Context, method, url string, body []byte) ([]byte, error) {
+	if c.breaker.isOpen() {
+		return nil, fmt.Errorf("headscale client: circuit breaker open for %s", c.BaseURL)
+	}
+	return c.doWithRetryUngated(ctx, method, url, body)
+}
+
+// doWithRetryUngated is doWithRetry without the open-breaker fast-fail. Health
+// uses it so its probe reaches Headscale while the breaker is open; its
+// result still records success or failure on the breaker.
+func (c *Client) doWithRetryUngated(ctx context.Context, method, url string, body []byte) ([]byte, error) {
+	var lastErr error
+	for attempt := 0; attempt <= c.RetryMax; attempt++ {
+		var bodyReader io.Reader
+		if body != nil {
+			bodyReader = bytes.NewReader(body)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, url, bodyReader)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := c.HTTPClient.Do(req)
+		if err != nil {
+			lastErr = err
+			c.breaker.recordFailure()
+			if attempt < c.RetryMax {
+				sleep(ctx, retryDelay(c.RetryBaseDelay, attempt, 0))
+				continue
+			}
+			return nil, lastErr
+		}
+
+		respBody, readErr := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if readErr != nil {
+			lastErr = readErr
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			if readErr != nil {
+				// A 200 with a body we couldn't fully read is not a success:
+				// returning a truncated/corrupted respBody as if it were
+				// complete would silently corrupt whatever JSON decode the
+				// caller does next.
+				return nil, fmt.Errorf("headscale API: reading response body: %w", readErr)
+			}
+			c.breaker.recordSuccess()
+			return respBody, nil
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+			lastErr = fmt.Errorf("headscale API request failed with status %d: %s", resp.StatusCode, string(respBody))
+			c.breaker.recordFailure()
+			if attempt < c.RetryMax {
+				sleep(ctx, retryDelay(c.RetryBaseDelay, attempt, retryAfter(resp.Header.Get("Retry-After"))))
+				continue
+			}
+			return nil, lastErr
+		default:
+			// Client errors (4xx other than 429) are not retried and do not
+			// count against the breaker: they indicate a bad request, not an
+			// unhealthy Headscale.
+			return nil, fmt.Errorf("headscale API request failed with status %d: %s", resp.StatusCode, string(respBody))
+		}
+	}
+
+	return nil, lastErr
+}
+
+// retryDelay computes the exponential backoff-with-jitter delay for attempt
+// (0-indexed), honoring a server-provided Retry-After override when > 0.
+func retryDelay(base time.Duration, attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return retryAfter
+	}
+	backoff := base << attempt
+	jitter := time.Duration(rand.Int63n(int64(base) + 1))
+	return backoff + jitter
+}
+
+// retryAfter parses a Retry-After header value expressed in seconds. It
+// returns 0 if the header is absent or not a plain integer (Headscale does
+// not send HTTP-date Retry-After values).
+func retryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	secs, err := strconv.Atoi(header)
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// sleep waits for d or until ctx is done, whichever comes first.
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,151 @@
+package headscale
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestClient_DoWithRetry_RetriesOn5xx verifies that a 500 response is
+// retried and a subsequent 200 is returned without error.
+func TestClient_DoWithRetry_RetriesOn5xx(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	c, err := NewClient(server.URL, "test-key")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	c.RetryBaseDelay = time.Millisecond
+
+	_, err = c.doWithRetry(context.Background(), http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatalf("expected success after retry, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 calls, got %d", calls)
+	}
+}
+
+// TestClient_DoWithRetry_TruncatedOKBody verifies that a 200 response whose
+// body can't be fully read (e.g. the connection drops mid-transfer) is
+// surfaced as an error instead of returned as a silently truncated success.
+func TestClient_DoWithRetry_TruncatedOKBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("short"))
+
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			t.Fatal("ResponseWriter does not support hijacking")
+		}
+		conn, _, err := hj.Hijack()
+		if err != nil {
+			t.Fatalf("hijack: %v", err)
+		}
+		conn.Close()
+	}))
+	defer server.Close()
+
+	c, err := NewClient(server.URL, "test-key")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	_, err = c.doWithRetry(context.Background(), http.MethodGet, server.URL, nil)
+	if err == nil {
+		t.Fatal("expected an error for a truncated 200 response body, got nil")
+	}
+}
+
+// TestClient_DoWithRetry_OpensBreaker verifies that repeated failures trip
+// the circuit breaker and subsequent calls fast-fail without hitting the
+// server.
+func TestClient_DoWithRetry_OpensBreaker(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	c, err := NewClient(server.URL, "test-key")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	c.RetryMax = 0
+	c.RetryBaseDelay = time.Millisecond
+	c.SetBreakerThreshold(2, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.doWithRetry(context.Background(), http.MethodGet, server.URL, nil); err == nil {
+			t.Fatal("expected error from failing server")
+		}
+	}
+
+	callsBeforeOpen := atomic.LoadInt32(&calls)
+
+	if _, err := c.doWithRetry(context.Background(), http.MethodGet, server.URL, nil); err == nil {
+		t.Fatal("expected breaker-open error")
+	}
+	if atomic.LoadInt32(&calls) != callsBeforeOpen {
+		t.Error("expected breaker to fast-fail without calling the server")
+	}
+}
+
+// TestRespCache_PositiveAndNegativeTTL verifies that successful and failed
+// responses are cached with their respective TTLs.
+func TestRespCache_PositiveAndNegativeTTL(t *testing.T) {
+	cache := newRespCache(time.Hour, time.Hour)
+
+	cache.put("ok", []byte("body"), nil)
+	entry, ok := cache.get("ok")
+	if !ok || string(entry.body) != "body" || entry.err != nil {
+		t.Errorf("expected cached success entry, got %+v, ok=%v", entry, ok)
+	}
+
+	cache.put("fail", nil, context.DeadlineExceeded)
+	entry, ok = cache.get("fail")
+	if !ok || entry.err != context.DeadlineExceeded {
+		t.Errorf("expected cached failure entry, got %+v, ok=%v", entry, ok)
+	}
+
+	if _, ok := cache.get("missing"); ok {
+		t.Error("expected cache miss for unknown key")
+	}
+}
+
+// TestRetryDelay_HonorsRetryAfter verifies that a positive Retry-After
+// override takes precedence over the computed backoff.
+func TestRetryDelay_HonorsRetryAfter(t *testing.T) {
+	d := retryDelay(100*time.Millisecond, 3, 10*time.Second)
+	if d != 10*time.Second {
+		t.Errorf("expected Retry-After to override backoff, got %v", d)
+	}
+}
+
+// TestRetryAfter_ParsesSeconds verifies header parsing, including the
+// absent and malformed cases.
+func TestRetryAfter_ParsesSeconds(t *testing.T) {
+	if d := retryAfter("5"); d != 5*time.Second {
+		t.Errorf("expected 5s, got %v", d)
+	}
+	if d := retryAfter(""); d != 0 {
+		t.Errorf("expected 0 for empty header, got %v", d)
+	}
+	if d := retryAfter("not-a-number"); d != 0 {
+		t.Errorf("expected 0 for malformed header, got %v", d)
+	}
+}
@@ -0,0 +1,298 @@
+// Package watch provides a background poller that keeps an in-memory,
+// tag-indexed snapshot of Headscale nodes up to date, so the k8s_cross DNS
+// hot path never has to make a ListNodes call (or even hit headscale.Client's
+// own response cache) to answer a query.
+package watch
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/wold9168/k8s_cross/headscale"
+)
+
+// watcherStale reports, per Watcher, whether it is currently serving a
+// snapshot older than refresh_interval because the last poll failed. It lets
+// operators tell "Headscale is down but we're coasting on cached data" apart
+// from "everything is fine".
+var watcherStale = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "coredns",
+	Subsystem: "headscale_watch",
+	Name:      "stale",
+	Help:      "1 if the watcher is serving a snapshot older than its refresh interval because the last poll failed, 0 otherwise.",
+}, []string{"base_url"})
+
+// defaultRefreshInterval, defaultNegativeTTL and defaultCacheSize are
+// Watcher's defaults when the Corefile doesn't override them via the
+// watch/watch_cache_size/watch_negative_ttl directives.
+const (
+	defaultRefreshInterval = 10 * time.Second
+	defaultNegativeTTL     = 5 * time.Second
+	defaultCacheSize       = 4096
+)
+
+// Clock abstracts time so tests can drive Watcher without sleeping.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// Source is the node listing a Watcher polls. *headscale.Client satisfies
+// this directly.
+type Source interface {
+	ListNodes(ctx context.Context, userFilter string) ([]headscale.Node, error)
+}
+
+// Watcher periodically lists nodes from a Source and maintains a
+// tag -> []Node index in memory, so repeated tag lookups (one per DNS query,
+// in the common case) never need to touch the network. It also accepts
+// pushed snapshots (see Push) for callers with their own webhook or
+// streaming update channel, bypassing the poll loop entirely.
+type Watcher struct {
+	source   Source
+	baseURL  string
+	clock    Clock
+	interval time.Duration
+
+	negativeTTL time.Duration
+	cacheSize   int
+	onUpdate    func([]headscale.Node)
+
+	mu       sync.RWMutex
+	nodes    []headscale.Node
+	index    map[string][]headscale.Node
+	tagOrder []string // insertion order, oldest first, for cacheSize eviction
+	negative map[string]time.Time
+	stale    bool
+	lastSync time.Time
+
+	stopCh chan struct{}
+}
+
+// NewWatcher builds a Watcher that polls source every interval (or
+// defaultRefreshInterval, if interval is zero) once Start is called. baseURL
+// is only used to label the stale Prometheus gauge.
+func NewWatcher(source Source, baseURL string, interval time.Duration) *Watcher {
+	if interval <= 0 {
+		interval = defaultRefreshInterval
+	}
+	return &Watcher{
+		source:      source,
+		baseURL:     baseURL,
+		clock:       realClock{},
+		interval:    interval,
+		negativeTTL: defaultNegativeTTL,
+		cacheSize:   defaultCacheSize,
+		index:       make(map[string][]headscale.Node),
+		negative:    make(map[string]time.Time),
+	}
+}
+
+// SetClock overrides the clock used for negative-cache TTLs and the stale
+// snapshot timestamp. Tests use this to inject a fake clock instead of
+// sleeping.
+func (w *Watcher) SetClock(clock Clock) {
+	w.clock = clock
+}
+
+// SetNegativeTTL overrides how long a tag that matched no node is treated as
+// a confirmed miss before a fresh lookup is attempted against the index
+// again.
+func (w *Watcher) SetNegativeTTL(ttl time.Duration) {
+	w.negativeTTL = ttl
+}
+
+// SetCacheSize caps how many distinct tags the index retains. Once the cap
+// is exceeded, the tags that first appear earliest in the node snapshot are
+// evicted (see evictOldest) to bound memory
+// under tag cardinality that grows without bound (e.g. a templated tag
+// scheme keyed on something high-cardinality).
+func (w *Watcher) SetCacheSize(size int) {
+	w.cacheSize = size
+}
+
+// SetOnUpdate registers a callback invoked with the full node snapshot at
+// the end of every successful Push (including the ones sync makes). It's
+// meant for metrics hooks like k8s_cross's nodes_indexed gauge, which need
+// to recompute from the snapshot whenever it changes; it is not called on a
+// failed sync, since the snapshot didn't change.
+func (w *Watcher) SetOnUpdate(fn func([]headscale.Node)) {
+	w.onUpdate = fn
+}
+
+// Start runs an initial sync, then refreshes the snapshot every interval
+// until Stop is called. ctx only bounds the initial sync (so a caller can
+// wrap it in a timeout to fail startup fast if Headscale is unreachable);
+// the background refresh loop always syncs against context.Background(), so
+// it keeps running for the Watcher's lifetime regardless of ctx's deadline.
+// The initial sync's error (if any) is returned directly; later sync
+// failures instead leave the watcher serving its last good snapshot and set
+// the stale gauge.
+func (w *Watcher) Start(ctx context.Context) error {
+	if err := w.sync(ctx); err != nil {
+		return fmt.Errorf("watch: initial sync: %w", err)
+	}
+
+	w.stopCh = make(chan struct{})
+	ticker := time.NewTicker(w.interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.sync(context.Background())
+			case <-w.stopCh:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop ends the background refresh loop started by Start.
+func (w *Watcher) Stop() {
+	if w.stopCh != nil {
+		close(w.stopCh)
+	}
+}
+
+// sync polls the source once and rebuilds the index. On failure it keeps
+// serving the previous snapshot and marks it stale rather than clearing the
+// index, so a transient Headscale outage degrades to serving last-known-good
+// answers instead of NXDOMAIN.
+func (w *Watcher) sync(ctx context.Context) error {
+	nodes, err := w.source.ListNodes(ctx, "")
+	if err != nil {
+		w.mu.Lock()
+		w.stale = true
+		w.mu.Unlock()
+		watcherStale.WithLabelValues(w.baseURL).Set(1)
+		return err
+	}
+
+	w.Push(nodes)
+	return nil
+}
+
+// Push replaces the watcher's snapshot with nodes directly, for callers that
+// receive updates out of band (e.g. a Headscale webhook) instead of relying
+// on the poll loop. It rebuilds the tag index and clears staleness exactly
+// as a successful poll would.
+//
+// A tag's negative-miss entry is only dropped once it's actually found in
+// the new index; a tag that's still absent keeps its cached miss so Lookup
+// continues to trust it for the rest of negativeTTL instead of re-deriving
+// the same "not found" on every sync.
+func (w *Watcher) Push(nodes []headscale.Node) {
+	index := make(map[string][]headscale.Node)
+	var order []string
+	for _, node := range nodes {
+		for _, tag := range allTags(node) {
+			if _, seen := index[tag]; !seen {
+				order = append(order, tag)
+			}
+			index[tag] = append(index[tag], node)
+		}
+	}
+
+	order = evictOldest(index, order, w.cacheSize)
+
+	w.mu.Lock()
+	w.nodes = nodes
+	w.index = index
+	w.tagOrder = order
+	for tag := range index {
+		delete(w.negative, tag)
+	}
+	w.stale = false
+	w.lastSync = w.clock.Now()
+	onUpdate := w.onUpdate
+	w.mu.Unlock()
+
+	watcherStale.WithLabelValues(w.baseURL).Set(0)
+	if onUpdate != nil {
+		onUpdate(nodes)
+	}
+}
+
+// evictOldest drops the oldest tags in order from index (mutating it in
+// place) until only the newest size entries remain, and returns the
+// surviving tags in their original order.
+func evictOldest(index map[string][]headscale.Node, order []string, size int) []string {
+	if size <= 0 || len(order) <= size {
+		return order
+	}
+	for _, tag := range order[:len(order)-size] {
+		delete(index, tag)
+	}
+	return order[len(order)-size:]
+}
+
+// allTags returns the union of a node's forced and valid tags.
+func allTags(node headscale.Node) []string {
+	tags := make([]string, 0, len(node.ForcedTags)+len(node.ValidTags))
+	tags = append(tags, node.ForcedTags...)
+	tags = append(tags, node.ValidTags...)
+	return tags
+}
+
+// Lookup returns the nodes carrying tag, consulting the negative-result
+// cache first so a tag that matched nothing on the last sync doesn't have to
+// be re-scanned on every query within negativeTTL. It never touches the
+// network; a miss before the index has ever seen tag is served straight
+// from memory.
+func (w *Watcher) Lookup(tag string) ([]headscale.Node, bool) {
+	w.mu.RLock()
+	if missedAt, ok := w.negative[tag]; ok && w.clock.Now().Sub(missedAt) < w.negativeTTL {
+		w.mu.RUnlock()
+		return nil, false
+	}
+	nodes, ok := w.index[tag]
+	w.mu.RUnlock()
+
+	if !ok {
+		w.recordMiss(tag)
+	}
+	return nodes, ok
+}
+
+// recordMiss notes that tag matched nothing as of now, so Lookup can
+// short-circuit future calls until negativeTTL elapses. It's a separate
+// method rather than folded into Lookup because Lookup takes an RLock; miss
+// bookkeeping needs the write lock.
+func (w *Watcher) recordMiss(tag string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.negative[tag] = w.clock.Now()
+}
+
+// Stale reports whether the watcher is currently serving a snapshot older
+// than its refresh interval because the last poll failed.
+func (w *Watcher) Stale() bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.stale
+}
+
+// LastSync returns the time of the most recent successful sync or push.
+func (w *Watcher) LastSync() time.Time {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.lastSync
+}
+
+// Nodes returns the full node snapshot from the most recent sync or push.
+func (w *Watcher) Nodes() []headscale.Node {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.nodes
+}
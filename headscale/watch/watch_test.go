@@ -0,0 +1,147 @@
+package watch
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/wold9168/k8s_cross/headscale"
+)
+
+// fakeClock is a manually advanced Clock for deterministic TTL tests.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) advance(d time.Duration) { c.now = c.now.Add(d) }
+
+// fakeSource is a Source whose ListNodes result (or error) is set by the
+// test between syncs.
+type fakeSource struct {
+	nodes []headscale.Node
+	err   error
+}
+
+func (f *fakeSource) ListNodes(ctx context.Context, userFilter string) ([]headscale.Node, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.nodes, nil
+}
+
+func nodeWithTags(id string, tags ...string) headscale.Node {
+	return headscale.Node{ID: id, ValidTags: tags}
+}
+
+// TestWatcher_LookupAfterSync verifies that a tag present on a node in the
+// polled snapshot is indexed and resolvable via Lookup.
+func TestWatcher_LookupAfterSync(t *testing.T) {
+	source := &fakeSource{nodes: []headscale.Node{nodeWithTags("node-1", "tag:svc-frontend")}}
+	w := NewWatcher(source, "http://headscale.test", time.Minute)
+
+	if err := w.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer w.Stop()
+
+	nodes, ok := w.Lookup("tag:svc-frontend")
+	if !ok || len(nodes) != 1 || nodes[0].ID != "node-1" {
+		t.Errorf("expected node-1 for tag:svc-frontend, got %+v, ok=%v", nodes, ok)
+	}
+
+	if _, ok := w.Lookup("tag:svc-unknown"); ok {
+		t.Error("expected miss for tag never seen in a sync")
+	}
+}
+
+// TestWatcher_StaleOnSyncFailure verifies that a failed poll keeps serving
+// the previous snapshot and sets Stale.
+func TestWatcher_StaleOnSyncFailure(t *testing.T) {
+	source := &fakeSource{nodes: []headscale.Node{nodeWithTags("node-1", "tag:svc-frontend")}}
+	w := NewWatcher(source, "http://headscale.test", time.Minute)
+
+	if err := w.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer w.Stop()
+
+	source.err = errors.New("headscale unreachable")
+	if err := w.sync(context.Background()); err == nil {
+		t.Fatal("expected sync to report the source error")
+	}
+
+	if !w.Stale() {
+		t.Error("expected watcher to be marked stale after a failed sync")
+	}
+
+	nodes, ok := w.Lookup("tag:svc-frontend")
+	if !ok || len(nodes) != 1 {
+		t.Errorf("expected stale watcher to keep serving last snapshot, got %+v, ok=%v", nodes, ok)
+	}
+}
+
+// TestWatcher_NegativeTTL verifies that a miss is remembered (not
+// re-derived) until negativeTTL elapses, using a fake clock instead of a
+// real sleep. It checks the internal negative-cache timestamp directly,
+// since Lookup's return value for an unknown tag is "not found" both before
+// and after the cached entry expires — the TTL only changes whether that
+// answer came from the cache or a fresh index scan.
+func TestWatcher_NegativeTTL(t *testing.T) {
+	source := &fakeSource{nodes: []headscale.Node{nodeWithTags("node-1", "tag:svc-frontend")}}
+	w := NewWatcher(source, "http://headscale.test", time.Minute)
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	w.SetClock(clock)
+	w.SetNegativeTTL(10 * time.Second)
+
+	if err := w.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer w.Stop()
+
+	if _, ok := w.Lookup("tag:svc-missing"); ok {
+		t.Fatal("expected initial miss")
+	}
+	firstMiss := w.negative["tag:svc-missing"]
+	if !firstMiss.Equal(clock.now) {
+		t.Fatalf("expected miss recorded at %v, got %v", clock.now, firstMiss)
+	}
+
+	clock.advance(5 * time.Second)
+	if _, ok := w.Lookup("tag:svc-missing"); ok {
+		t.Error("expected cached miss to still apply before negativeTTL elapses")
+	}
+	if got := w.negative["tag:svc-missing"]; !got.Equal(firstMiss) {
+		t.Errorf("expected cached-miss timestamp to stay at %v while still within TTL, got %v", firstMiss, got)
+	}
+
+	clock.advance(6 * time.Second)
+	if _, ok := w.Lookup("tag:svc-missing"); ok {
+		t.Error("expected tag to still be absent from the index")
+	}
+	if got := w.negative["tag:svc-missing"]; !got.Equal(clock.now) {
+		t.Errorf("expected miss timestamp to refresh to %v once negativeTTL elapsed, got %v", clock.now, got)
+	}
+}
+
+// TestWatcher_CacheSizeEviction verifies that the tag index is capped at
+// cacheSize entries, evicting the oldest tags first.
+func TestWatcher_CacheSizeEviction(t *testing.T) {
+	source := &fakeSource{}
+	w := NewWatcher(source, "http://headscale.test", time.Minute)
+	w.SetCacheSize(1)
+
+	w.Push([]headscale.Node{
+		nodeWithTags("node-1", "tag:svc-a"),
+		nodeWithTags("node-2", "tag:svc-b"),
+	})
+
+	if _, ok := w.Lookup("tag:svc-a"); ok {
+		t.Error("expected the older tag to have been evicted")
+	}
+	if _, ok := w.Lookup("tag:svc-b"); !ok {
+		t.Error("expected the newest tag to survive eviction")
+	}
+}
@@ -8,12 +8,10 @@ package k8s_cross
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
 	"net"
-	"net/http"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
@@ -22,222 +20,76 @@ import (
 	"github.com/coredns/coredns/request"
 
 	"github.com/miekg/dns"
+
+	"github.com/wold9168/k8s_cross/headscale"
+	"github.com/wold9168/k8s_cross/headscale/watch"
+	"github.com/wold9168/k8s_cross/mcs"
 )
 
 // Define a logger with the plugin name. This allows us to use log.Info and
 // other related methods for logging.
 var log = clog.NewWithPlugin("k8s_cross")
 
-// HeadscaleClient interface defines the methods that need to be implemented for interacting with Headscale.
-type HeadscaleClient interface {
-	GetNode(ctx context.Context, nodeId string) (*Node, error)
-	ListNodes(ctx context.Context, userFilter string) ([]Node, error)
-	Health(ctx context.Context) (*HealthResponse, error)
-	CreateUser(ctx context.Context, req *CreateUserRequest) (*User, error)
-}
-
-// Client represents a client for the Headscale API.
-type Client struct {
-	BaseURL    string
-	APIKey     string
-	HTTPClient *http.Client
-}
-
-// NewClient creates a new Headscale API client.
-func NewClient(baseURL, apiKey string) *Client {
-	return &Client{
-		BaseURL: baseURL,
-		APIKey:  apiKey,
-		HTTPClient: &http.Client{
-			Timeout: 30 * time.Second,
-		},
-	}
-}
-
-// Node represents a node in the Headscale network.
-type Node struct {
-	ID           string    `json:"id"`
-	MachineKey   string    `json:"machineKey"`
-	NodeKey      string    `json:"nodeKey"`
-	DiscoKey     string    `json:"discoKey"`
-	IPAddresses  []string  `json:"ipAddresses"`
-	Name         string    `json:"name"`
-	User         User      `json:"user"`
-	LastSeen     time.Time `json:"lastSeen"`
-	Expiry       time.Time `json:"expiry"`
-	CreatedAt    time.Time `json:"createdAt"`
-	RegisterMethod string  `json:"registerMethod"`
-	Online       bool      `json:"online"`
-	ApprovedRoutes []string `json:"approvedRoutes"`
-	AvailableRoutes []string `json:"availableRoutes"`
-}
-
-// User represents a user in the Headscale system.
-type User struct {
-	ID          string `json:"id"`
-	Name        string `json:"name"`
-	CreatedAt   time.Time `json:"createdAt"`
-	DisplayName string `json:"displayName"`
-	Email       string `json:"email"`
-}
-
-// ListNodesResponse represents the response from the ListNodes API endpoint.
-type ListNodesResponse struct {
-	Nodes []Node `json:"nodes"`
-}
-
-// GetNodeResponse represents the response from the GetNode API endpoint.
-type GetNodeResponse struct {
-	Node Node `json:"node"`
-}
-
-// GetNode retrieves a specific node by ID from Headscale.
-func (c *Client) GetNode(ctx context.Context, nodeId string) (*Node, error) {
-	url := fmt.Sprintf("%s/api/v1/node/%s", c.BaseURL, nodeId)
-
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Authorization", "Bearer "+c.APIKey)
-
-	resp, err := c.HTTPClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
-	}
-
-	var getResp GetNodeResponse
-	if err := json.NewDecoder(resp.Body).Decode(&getResp); err != nil {
-		return nil, err
-	}
-
-	return &getResp.Node, nil
-}
-
-// ListNodes retrieves all nodes from Headscale.
-func (c *Client) ListNodes(ctx context.Context, userFilter string) ([]Node, error) {
-	url := fmt.Sprintf("%s/api/v1/node", c.BaseURL)
-
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	if userFilter != "" {
-		q := req.URL.Query()
-		q.Add("user", userFilter)
-		req.URL.RawQuery = q.Encode()
-	}
-
-	req.Header.Set("Authorization", "Bearer "+c.APIKey)
-
-	resp, err := c.HTTPClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
-	}
-
-	var listResp ListNodesResponse
-	if err := json.NewDecoder(resp.Body).Decode(&listResp); err != nil {
-		return nil, err
-	}
-
-	return listResp.Nodes, nil
-}
-
-// HealthResponse represents the response from the health API endpoint.
-type HealthResponse struct {
-	DatabaseConnectivity bool `json:"databaseConnectivity"`
-}
-
-// Health checks the health status of the Headscale server.
-func (c *Client) Health(ctx context.Context) (*HealthResponse, error) {
-	url := fmt.Sprintf("%s/api/v1/health", c.BaseURL)
-
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Authorization", "Bearer "+c.APIKey)
-
-	resp, err := c.HTTPClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("health check failed with status %d: %s", resp.StatusCode, string(body))
-	}
-
-	var healthResp HealthResponse
-	if err := json.NewDecoder(resp.Body).Decode(&healthResp); err != nil {
-		return nil, err
-	}
-
-	return &healthResp, nil
+// HeadscaleClient is the subset of the headscale package's client that the
+// plugin depends on. It's a type alias, not a redeclared interface, so that
+// *headscale.Client (and test fakes built against headscale.Node) satisfy it
+// without a second, divergent definition of the Headscale API shape.
+type HeadscaleClient = headscale.HeadscaleClient
+
+// Node is an alias for headscale.Node, kept so the rest of this file (and
+// its tests) can refer to "Node" the way they did before the client moved
+// into its own package.
+type Node = headscale.Node
+
+// defaultSRVPort is what buildSRVRecords advertises for a service with no
+// matching entry in SRVPorts, preserving the plugin's historical behavior of
+// a single _http._tcp/80 record.
+var defaultSRVPort = srvPort{Port: 80, Proto: "tcp", Name: "http"}
+
+// srvPort is the port/proto/name buildSRVRecords advertises for one service,
+// set via the `srv_port` Corefile directive. It mirrors the real per-port
+// data buildSRVRecordsFromEndpoints reads off an EndpointSlice, for
+// deployments on the plain-Headscale matching path that have no EndpointSlice
+// to read it from.
+type srvPort struct {
+	Port  uint16
+	Proto string
+	Name  string
 }
 
-// CreateUserRequest represents the request for creating a new user.
-type CreateUserRequest struct {
-	Name        string `json:"name"`
-	DisplayName string `json:"displayName"`
-	Email       string `json:"email"`
+// srvPortKey builds the SRVPorts lookup key for namespace/service, the same
+// "namespace/service" shape joinKeyStore and mcs's index use.
+func srvPortKey(namespace, service string) string {
+	return namespace + "/" + service
 }
 
-// CreateUserResponse represents the response from the CreateUser API endpoint.
-type CreateUserResponse struct {
-	User User `json:"user"`
-}
-
-// CreateUser creates a new user in Headscale.
-func (c *Client) CreateUser(ctx context.Context, req *CreateUserRequest) (*User, error) {
-	url := fmt.Sprintf("%s/api/v1/user", c.BaseURL)
-
-	jsonData, err := json.Marshal(req)
-	if err != nil {
-		return nil, err
-	}
-
-	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return nil, err
-	}
-
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("Authorization", "Bearer "+c.APIKey)
-
-	resp, err := c.HTTPClient.Do(httpReq)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("create user failed with status %d: %s", resp.StatusCode, string(body))
-	}
-
-	var createUserResp CreateUserResponse
-	if err := json.NewDecoder(resp.Body).Decode(&createUserResp); err != nil {
-		return nil, err
-	}
+// matchModeNamePrefix is the legacy, best-effort service matching mode that
+// substring-matches the service and namespace against the node name. It
+// exists only for operators who haven't tagged their nodes yet; the default
+// mode below is what KEP-1645 deployments should use.
+const matchModeNamePrefix = "name-prefix"
+
+// Answer-family policies accepted by the `answer_family` Corefile directive
+// and consulted by buildARecords/buildAAAARecords. They control what happens
+// when a node is dual-stack: "dual" (the default) advertises every address
+// of the queried record type regardless of what else the node has; the
+// "prefer-*" modes suppress the non-preferred family on a node that also has
+// the preferred one, while still falling back to whichever family is
+// actually available on single-stack nodes; the "*-only" modes never
+// advertise the other family at all, even if it's the only one present.
+const (
+	answerFamilyDual     = "dual"
+	answerFamilyPreferV4 = "prefer-v4"
+	answerFamilyPreferV6 = "prefer-v6"
+	answerFamilyV4Only   = "v4-only"
+	answerFamilyV6Only   = "v6-only"
+)
 
-	return &createUserResp.User, nil
+// MCSLookup is the read side of the mcs informer index that handleClustersetQuery
+// consults in place of findServiceNodes when the plugin has been configured with
+// a Kubernetes client (see the `incluster`/`kubeconfig` Corefile directives).
+type MCSLookup interface {
+	Lookup(namespace, service string) ([]mcs.ClusterEndpoint, bool)
 }
 
 // K8sCross is the main structure for the k8s_cross plugin, handling DNS requests for multi-cluster services.
@@ -250,6 +102,129 @@ type K8sCross struct {
 	TTL             uint32
 	ClusterName     string
 	ClusterSet      string
+
+	// Namespace scopes ServiceExport reconciliation and Headscale user/tag
+	// creation when not overridden per-query. It defaults to the service
+	// account's own namespace when running with `incluster`.
+	Namespace string
+
+	// MatchMode selects how findServiceNodes identifies a service's nodes.
+	// The zero value means tag-based matching (tag:mcs-<clusterset>-<namespace>-<service>);
+	// matchModeNamePrefix opts into the legacy node-name substring match for
+	// operators who haven't tagged their nodes yet.
+	MatchMode string
+
+	// TagTemplate overrides the Go template serviceTag executes to compute a
+	// service's Headscale ACL tag in tag-based match mode. The zero value
+	// means defaultTagTemplate, which reproduces the tag:mcs-<clusterset>-
+	// <namespace>-<service> vocabulary above. Set by the `tag_template`
+	// Corefile directive for operators whose existing ACL tags follow a
+	// different convention (e.g. "tag:svc-{{.Service}}").
+	TagTemplate string
+
+	// SRVPorts maps "namespace/service" (see srvPortKey) to the port/proto/
+	// name buildSRVRecords advertises for that service, set by the
+	// `srv_port` Corefile directive. A service with no entry falls back to
+	// defaultSRVPort, matching the plugin's historical _http._tcp/80
+	// behavior. Unused on the MCS path, which reads real ports off each
+	// service's EndpointSlice instead; see buildSRVRecordsFromEndpoints.
+	SRVPorts map[string]srvPort
+
+	// AnswerFamily selects how buildARecords/buildAAAARecords handle
+	// dual-stack nodes. The zero value means answerFamilyDual; see the
+	// answerFamily* constants for the other modes.
+	AnswerFamily string
+
+	// ReverseZones are the CIDRs this plugin is authoritative for PTR
+	// answers under (see the `reverse` Corefile directive). A query is a
+	// clusterset query if it matches one of Zones or decodes to an address
+	// inside one of these. PTR support requires MCS (`incluster`/
+	// `kubeconfig`): rebuildReverseIndex has no other source to populate
+	// reverseIdx from, so setup.go refuses `reverse` without one rather than
+	// accepting CIDRs that can never resolve.
+	ReverseZones []*net.IPNet
+
+	// reverseIdx is the IP->FQDN index handlePTRQuery reads from. It's kept
+	// in sync with the forward lookups by rebuildReverseIndex, which only
+	// ever runs when MCS is configured; see isReverseQuery.
+	reverseIdx *reverseIndex
+
+	// MCS, when non-nil, is the client-go informer-backed index of
+	// ServiceImport/EndpointSlice resources. When set it is authoritative for
+	// service discovery; Headscale is only consulted to translate the
+	// cluster-local IPs of remote ServiceImports into Headscale tailnet IPs.
+	MCS MCSLookup
+
+	// mcsController holds the concrete controller constructed in setup.go so
+	// it can be started/stopped; MCS only needs the narrower Lookup view.
+	mcsController *mcs.Controller
+
+	// Watcher, when non-nil, answers findServiceNodesByTag from its
+	// in-memory node index instead of calling HeadscaleClient.ListNodesByTag
+	// on every query. Enabled by the `watch` Corefile directive; see
+	// setup.go.
+	Watcher *watch.Watcher
+
+	// joinKeys holds the Headscale pre-auth keys reconcileTags provisions for
+	// ServiceExport endpoints that haven't joined the tailnet yet. It's nil
+	// unless an MCS controller is configured, since only reconcileTags
+	// writes to it; see JoinKey.
+	joinKeys *joinKeyStore
+
+	// tagTmpl is TagTemplate (or defaultTagTemplate), parsed once by setup.go
+	// so serviceTag doesn't reparse it on every query. It's a pointer for the
+	// same reason Watcher and reverseIdx are: a nil tagTmpl (as in tests that
+	// build a K8sCross literal directly) just makes serviceTag parse
+	// TagTemplate/defaultTagTemplate on the spot instead.
+	tagTmpl *template.Template
+
+	// Fallthrough controls whether ServeDNS passes a query for which no
+	// service nodes were found on to the next plugin instead of answering
+	// with an empty record set. Set by the `fallthrough` Corefile directive;
+	// its zero value never falls through, matching the plugin's historical
+	// behavior.
+	Fallthrough fallthroughConfig
+
+	// ReadyTimeout bounds how long the Watcher's initial sync (see setup.go)
+	// may run at startup before setup gives up and fails. Set by the
+	// `ready_timeout` Corefile directive; the zero value means no bound.
+	ReadyTimeout time.Duration
+
+	// ready caches Ready's last Headscale health check so CoreDNS's own
+	// readiness polling doesn't hit HeadscaleClient.Health on every check.
+	// It's a pointer, set up in setup.go, because Ready has a value receiver
+	// like the rest of this type and so can't persist state into e directly;
+	// a nil ready (as in tests that build a K8sCross literal) just disables
+	// the cache and checks health on every call.
+	ready *readyCache
+}
+
+// fallthroughConfig is the parsed form of the `fallthrough [ZONES...]`
+// Corefile directive, following the convention CoreDNS plugins commonly
+// expose via plugin/pkg/fall: omitting every zone argument falls through for
+// any zone the plugin is configured for, while naming zones restricts it to
+// just those.
+type fallthroughConfig struct {
+	enabled bool
+	zones   []string
+}
+
+// through reports whether a query for name, once determined to have no
+// matching service nodes, should fall through to the next plugin rather
+// than be answered with an empty record set.
+func (f fallthroughConfig) through(name string) bool {
+	if !f.enabled {
+		return false
+	}
+	if len(f.zones) == 0 {
+		return true
+	}
+	for _, zone := range f.zones {
+		if name == zone+"." || strings.HasSuffix(name, "."+zone+".") {
+			return true
+		}
+	}
+	return false
 }
 
 // ServeDNS implements the plugin.Handler interface. This is the entry point for the plugin to handle DNS requests.
@@ -261,6 +236,8 @@ type K8sCross struct {
 // - int: DNS response code
 // - error: Error during processing
 func (e K8sCross) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	registerMetrics()
+
 	// Log received request for debugging
 	log.Debug("Received DNS request")
 
@@ -281,37 +258,129 @@ func (e K8sCross) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg
 	// Increase request count metric
 	requestCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
 
+	zone, ok := e.matchedZone(qName)
+	if !ok {
+		zone = "reverse"
+	}
+	qType := dns.TypeToString[q.Qtype]
+
 	log.Debugf("Processing clusterset.local query: %s", qName)
 
 	// Handle the multi-cluster service query
-	resp, err := e.handleClustersetQuery(ctx, state, q)
+	resp, noMatch, err := e.handleClustersetQuery(ctx, state, q)
 	if err != nil {
 		log.Errorf("Error handling clusterset query: %v", err)
+		requestsTotal.WithLabelValues(zone, qType, dns.RcodeToString[dns.RcodeServerFailure]).Inc()
 		return dns.RcodeServerFailure, err
 	}
 
+	// No service nodes matched; defer to the next plugin instead of
+	// answering empty if the Corefile opted into fallthrough for this zone.
+	if noMatch && e.Fallthrough.through(qName) {
+		return plugin.NextOrFailure(e.Name(), e.Next, ctx, w, r)
+	}
+
 	// Write the response
 	err = w.WriteMsg(resp)
 	if err != nil {
 		log.Errorf("Error writing response: %v", err)
+		requestsTotal.WithLabelValues(zone, qType, dns.RcodeToString[dns.RcodeServerFailure]).Inc()
 		return dns.RcodeServerFailure, err
 	}
 
+	requestsTotal.WithLabelValues(zone, qType, dns.RcodeToString[resp.Rcode]).Inc()
 	return dns.RcodeSuccess, nil
 }
 
-// isClustersetQuery checks if the DNS query targets the clusterset.local domain
+// isClustersetQuery checks if the DNS query targets the clusterset.local
+// domain, either as a forward lookup under one of Zones or as a PTR lookup
+// whose encoded address falls inside one of ReverseZones.
 func (e K8sCross) isClustersetQuery(name string) bool {
+	if _, ok := e.matchedZone(name); ok {
+		return true
+	}
+	return e.isReverseQuery(name)
+}
+
+// matchedZone returns the configured Zones entry name is a query under, for
+// labeling the requests_total metric. Reverse (PTR) queries don't match any
+// entry in Zones, so callers fall back to a fixed "reverse" label for them.
+func (e K8sCross) matchedZone(name string) (string, bool) {
 	for _, zone := range e.Zones {
 		if strings.HasSuffix(name, "."+zone+".") {
+			return zone, true
+		}
+	}
+	return "", false
+}
+
+// isReverseQuery reports whether name is a PTR query name (under
+// in-addr.arpa or ip6.arpa) that decodes to an address in one of
+// ReverseZones. It only claims a match when e.MCS is configured, since
+// rebuildReverseIndex (the only thing that ever writes to reverseIdx) walks
+// the MCS-backed service set; without it reverseIdx stays permanently empty
+// and claiming authority over a reverse zone would just turn every PTR query
+// in range into a hard NXDOMAIN instead of falling through to the next
+// plugin. See the `incluster`/`kubeconfig` Corefile directives.
+func (e K8sCross) isReverseQuery(name string) bool {
+	if e.MCS == nil {
+		return false
+	}
+	ip := reverseNameToIP(name)
+	if ip == nil {
+		return false
+	}
+	for _, zone := range e.ReverseZones {
+		if zone.Contains(ip) {
 			return true
 		}
 	}
 	return false
 }
 
-// handleClustersetQuery handles DNS queries for services in the clusterset.local domain
-func (e K8sCross) handleClustersetQuery(ctx context.Context, state request.Request, q dns.Question) (*dns.Msg, error) {
+// reverseNameToIP decodes a PTR question name under in-addr.arpa or
+// ip6.arpa back into the address it encodes, or returns nil if name isn't
+// a well-formed reverse name of either kind.
+func reverseNameToIP(name string) net.IP {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+
+	if labels, ok := reverseLabels(name, ".in-addr.arpa"); ok && len(labels) == 4 {
+		return net.ParseIP(strings.Join(labels, "."))
+	}
+
+	if labels, ok := reverseLabels(name, ".ip6.arpa"); ok && len(labels) == 32 {
+		var b strings.Builder
+		for i, nibble := range labels {
+			b.WriteString(nibble)
+			if i%4 == 3 && i != len(labels)-1 {
+				b.WriteByte(':')
+			}
+		}
+		return net.ParseIP(b.String())
+	}
+
+	return nil
+}
+
+// reverseLabels strips suffix from name and returns its remaining
+// dot-separated labels in address order (reversed from DNS wire order).
+func reverseLabels(name, suffix string) ([]string, bool) {
+	if !strings.HasSuffix(name, suffix) {
+		return nil, false
+	}
+	labels := strings.Split(strings.TrimSuffix(name, suffix), ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return labels, true
+}
+
+// handleClustersetQuery handles DNS queries for services in the
+// clusterset.local domain. Its second return value, noMatch, tells ServeDNS
+// whether the query was well-formed but matched zero service nodes, so it
+// can fall through to the next plugin instead of answering with resp when
+// the Corefile's `fallthrough` directive covers the queried zone.
+func (e K8sCross) handleClustersetQuery(ctx context.Context, state request.Request, q dns.Question) (*dns.Msg, bool, error) {
 	resp := new(dns.Msg)
 	resp.SetReply(state.Req)
 	resp.Authoritative = true
@@ -319,91 +388,445 @@ func (e K8sCross) handleClustersetQuery(ctx context.Context, state request.Reque
 	qName := strings.ToLower(q.Name)
 	qType := q.Qtype
 
-	// Parse the domain name to extract service, namespace, and cluster information
-	service, namespace, isValid := e.parseClusterSetDomain(qName)
+	if qType == dns.TypePTR {
+		resp, err := e.handlePTRQuery(resp, state, qName)
+		return resp, false, err
+	}
+
+	// Parse the domain name to extract service, namespace, and query shape.
+	parsed, isValid := e.parseClusterSetDomain(qName)
 	if !isValid {
 		log.Debugf("Invalid clusterset domain: %s", qName)
 		resp.SetRcode(state.Req, dns.RcodeNameError)
-		return resp, nil
+		return resp, false, nil
 	}
+	service, namespace := parsed.Service, parsed.Namespace
 
 	log.Debugf("Processing query for service: %s, namespace: %s, type: %s", service, namespace, dns.TypeToString[qType])
 
+	// Prefer the live ServiceImport/EndpointSlice index when the plugin has
+	// been configured with a Kubernetes client; it replaces the coarse
+	// Headscale node listing with real multi-cluster service membership.
+	if e.MCS != nil {
+		if endpoints, ok := e.MCS.Lookup(namespace, service); ok {
+			switch parsed.Kind {
+			case queryKindClusterScoped:
+				endpoints = filterEndpointsByCluster(endpoints, parsed.Cluster)
+			case queryKindHeadless:
+				endpoints = filterEndpointsByHostname(endpoints, parsed.Hostname)
+			}
+
+			nodes, err := e.resolveEndpoints(ctx, endpoints)
+			if err != nil {
+				log.Errorf("Error resolving multi-cluster endpoints: %v", err)
+				resp.SetRcode(state.Req, dns.RcodeServerFailure)
+				return resp, false, nil
+			}
+			noMatch := len(nodes) == 0
+
+			var answers []dns.RR
+			switch qType {
+			case dns.TypeA:
+				answers = renameForScope(e.buildARecords(nodes, service, namespace), parsed, qName)
+			case dns.TypeAAAA:
+				answers = renameForScope(e.buildAAAARecords(nodes, service, namespace), parsed, qName)
+			case dns.TypeSRV:
+				answers = e.buildSRVRecordsFromEndpoints(endpoints, service, namespace)
+			case dns.TypeTXT:
+				answers = renameForScope(e.buildTXTRecords(nodes, service, namespace), parsed, qName)
+			default:
+				resp.SetRcode(state.Req, dns.RcodeSuccess)
+				return resp, false, nil
+			}
+
+			resp.Answer = answers
+			return resp, noMatch, nil
+		}
+	}
+
 	// Find nodes that match the service and namespace in the Headscale network
 	nodes, err := e.findServiceNodes(ctx, service, namespace)
 	if err != nil {
 		log.Errorf("Error finding service nodes: %v", err)
 		resp.SetRcode(state.Req, dns.RcodeServerFailure)
-		return resp, nil
+		return resp, false, nil
 	}
 
+	switch parsed.Kind {
+	case queryKindClusterScoped:
+		nodes = filterNodesByCluster(nodes, parsed.Cluster)
+	case queryKindHeadless:
+		nodes = filterNodesByHostname(nodes, parsed.Hostname)
+	}
+	noMatch := len(nodes) == 0
+
 	// Build DNS records based on the found nodes
 	var answers []dns.RR
 	switch qType {
 	case dns.TypeA:
-		answers = e.buildARecords(nodes, service, namespace)
+		answers = renameForScope(e.buildARecords(nodes, service, namespace), parsed, qName)
 	case dns.TypeAAAA:
-		answers = e.buildAAAARecords(nodes, service, namespace)
+		answers = renameForScope(e.buildAAAARecords(nodes, service, namespace), parsed, qName)
 	case dns.TypeSRV:
 		answers = e.buildSRVRecords(nodes, service, namespace)
 	case dns.TypeTXT:
-		answers = e.buildTXTRecords(nodes, service, namespace)
+		answers = renameForScope(e.buildTXTRecords(nodes, service, namespace), parsed, qName)
 	default:
 		// For unsupported types, just return no error
 		resp.SetRcode(state.Req, dns.RcodeSuccess)
-		return resp, nil
+		return resp, false, nil
 	}
 
 	resp.Answer = answers
+	return resp, noMatch, nil
+}
+
+// renameForScope rewrites the header name of A/AAAA/TXT answers to the
+// literal queried name when it differs from the plain
+// <service>.<namespace>.svc.clusterset.local form buildARecords/
+// buildAAAARecords/buildTXTRecords assume — i.e. for cluster-scoped and
+// headless queries. SRV answers aren't covered: their name carries the
+// _port._proto prefix, which a scoped rewrite would destroy, so cluster-
+// scoped/headless SRV lookups are still answered under the service-level
+// name.
+func renameForScope(records []dns.RR, parsed parsedClusterSetName, qName string) []dns.RR {
+	if parsed.Kind == queryKindService {
+		return records
+	}
+	for _, r := range records {
+		r.Header().Name = qName
+	}
+	return records
+}
+
+// filterEndpointsByCluster keeps only the endpoints belonging to cluster.
+func filterEndpointsByCluster(endpoints []mcs.ClusterEndpoint, cluster string) []mcs.ClusterEndpoint {
+	var filtered []mcs.ClusterEndpoint
+	for _, ep := range endpoints {
+		if ep.ClusterID == cluster {
+			filtered = append(filtered, ep)
+		}
+	}
+	return filtered
+}
+
+// filterEndpointsByHostname keeps only the endpoint registered under hostname.
+func filterEndpointsByHostname(endpoints []mcs.ClusterEndpoint, hostname string) []mcs.ClusterEndpoint {
+	var filtered []mcs.ClusterEndpoint
+	for _, ep := range endpoints {
+		if strings.EqualFold(ep.Hostname, hostname) {
+			filtered = append(filtered, ep)
+		}
+	}
+	return filtered
+}
+
+// filterNodesByCluster keeps only the nodes tagged for cluster, using the
+// same tag:cluster-<cluster> vocabulary as findServiceNodesByTag's
+// tag:mcs-<clusterset>-<namespace>-<service>.
+func filterNodesByCluster(nodes []*Node, cluster string) []*Node {
+	tag := fmt.Sprintf("tag:cluster-%s", cluster)
+	var filtered []*Node
+	for _, node := range nodes {
+		if node.HasTag(tag) {
+			filtered = append(filtered, node)
+		}
+	}
+	return filtered
+}
+
+// filterNodesByHostname keeps only the node named hostname.
+func filterNodesByHostname(nodes []*Node, hostname string) []*Node {
+	var filtered []*Node
+	for _, node := range nodes {
+		if strings.EqualFold(node.Name, hostname) {
+			filtered = append(filtered, node)
+		}
+	}
+	return filtered
+}
+
+// handlePTRQuery answers a PTR query for qName by looking up the address it
+// encodes in the reverse index that rebuildReverseIndex keeps in sync with
+// the forward A/AAAA answers.
+func (e K8sCross) handlePTRQuery(resp *dns.Msg, state request.Request, qName string) (*dns.Msg, error) {
+	ip := reverseNameToIP(qName)
+	if ip == nil || e.reverseIdx == nil {
+		resp.SetRcode(state.Req, dns.RcodeNameError)
+		return resp, nil
+	}
+
+	fqdn, ok := e.reverseIdx.lookup(ip.String())
+	if !ok {
+		resp.SetRcode(state.Req, dns.RcodeNameError)
+		return resp, nil
+	}
+
+	resp.Answer = []dns.RR{&dns.PTR{
+		Hdr: dns.RR_Header{
+			Name:   qName,
+			Rrtype: dns.TypePTR,
+			Class:  dns.ClassINET,
+			Ttl:    e.TTL,
+		},
+		Ptr: fqdn,
+	}}
 	return resp, nil
 }
 
-// parseClusterSetDomain parses a clusterset.local domain and extracts service and namespace
-func (e K8sCross) parseClusterSetDomain(name string) (service, namespace string, valid bool) {
+// resolveEndpoints turns the mcs index's ClusterEndpoints into the plugin's
+// Node shape so the existing buildARecords/buildAAAARecords/buildTXTRecords
+// helpers can stay in terms of one type. Endpoints belonging to the local
+// cluster carry routable in-cluster IPs already; endpoints from remote
+// clusters carry that remote cluster's cluster-local IPs, which are not
+// reachable directly, so those are translated into Headscale tailnet IPs of
+// the node that's proxying the remote service.
+func (e K8sCross) resolveEndpoints(ctx context.Context, endpoints []mcs.ClusterEndpoint) ([]*Node, error) {
+	nodes := make([]*Node, 0, len(endpoints))
+	for _, ep := range endpoints {
+		ips := ep.IPs
+		if ep.ClusterID != "" && ep.ClusterID != e.ClusterName {
+			translated, err := e.translateToTailnet(ctx, ep)
+			if err != nil {
+				log.Warningf("Could not translate cluster-local IPs for cluster %s: %v", ep.ClusterID, err)
+			} else {
+				ips = translated
+			}
+		}
+
+		nodes = append(nodes, &Node{
+			Name:        ep.Hostname,
+			IPAddresses: ips,
+		})
+	}
+	return nodes, nil
+}
+
+// translateToTailnet resolves the Headscale tailnet IPs standing in for a
+// remote cluster's cluster-local endpoint addresses. It matches Headscale
+// nodes by hostname, since the mcs-api EndpointSlice carries the remote
+// pod/service hostname but not its tailnet identity directly.
+func (e K8sCross) translateToTailnet(ctx context.Context, ep mcs.ClusterEndpoint) ([]string, error) {
+	if e.HeadscaleClient == nil || ep.Hostname == "" {
+		return nil, fmt.Errorf("no Headscale client or hostname to translate with")
+	}
+
+	var nodes []Node
+	err := instrumentHeadscale("list_nodes", func() error {
+		var listErr error
+		nodes, listErr = e.HeadscaleClient.ListNodes(ctx, "")
+		return listErr
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, node := range nodes {
+		if strings.EqualFold(node.Name, ep.Hostname) {
+			return node.IPAddresses, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no Headscale node found for hostname %q", ep.Hostname)
+}
+
+// queryKind discriminates the clusterset domain name shapes
+// parseClusterSetDomain recognizes.
+type queryKind int
+
+const (
+	// queryKindService is <service>.<namespace>.svc.clusterset.local —
+	// every node backing the service across every cluster in the clusterset.
+	queryKindService queryKind = iota
+	// queryKindClusterScoped is
+	// <service>.<namespace>.svc.<cluster>.clusterset.local — only the
+	// nodes backing the service in the named cluster.
+	queryKindClusterScoped
+	// queryKindHeadless is
+	// <hostname>.<service>.<namespace>.svc.clusterset.local — the single
+	// backing node registered under hostname, for headless services where
+	// callers need a specific endpoint rather than the load-balanced set.
+	queryKindHeadless
+)
+
+// parsedClusterSetName is what parseClusterSetDomain extracts from a
+// clusterset domain name.
+type parsedClusterSetName struct {
+	Kind      queryKind
+	Service   string
+	Namespace string
+	Cluster   string // set only for queryKindClusterScoped
+	Hostname  string // set only for queryKindHeadless
+}
+
+// parseClusterSetDomain parses a clusterset.local domain name into its
+// service/namespace and, depending on shape, a cluster-scope or headless
+// hostname. See queryKind for the three shapes it recognizes.
+func (e K8sCross) parseClusterSetDomain(name string) (parsedClusterSetName, bool) {
 	name = strings.TrimSuffix(name, ".")
-	
-	// Expected format: <service>.<namespace>.svc.clusterset.local
-	// Example: my-service.my-namespace.svc.clusterset.local
 	parts := strings.Split(name, ".")
-	
-	if len(parts) < 5 {
-		return "", "", false
+
+	// Every shape ends in "...svc[.<cluster>].clusterset.local".
+	if len(parts) < 5 || parts[len(parts)-1] != "local" || parts[len(parts)-2] != "clusterset" {
+		return parsedClusterSetName{}, false
 	}
-	
-	// Check if domain ends with "svc.clusterset.local"
-	if parts[len(parts)-1] != "local" || parts[len(parts)-2] != "clusterset" || parts[len(parts)-3] != "svc" {
-		return "", "", false
+	rest := parts[:len(parts)-2]
+
+	if rest[len(rest)-1] == "svc" {
+		// <...>.<service>.<namespace>.svc — plain or headless.
+		if len(rest) < 3 {
+			return parsedClusterSetName{}, false
+		}
+		namespace := rest[len(rest)-2]
+		service := rest[len(rest)-3]
+		labels := rest[:len(rest)-3]
+
+		switch len(labels) {
+		case 0:
+			return parsedClusterSetName{Kind: queryKindService, Service: service, Namespace: namespace}, true
+		case 1:
+			return parsedClusterSetName{Kind: queryKindHeadless, Service: service, Namespace: namespace, Hostname: labels[0]}, true
+		default:
+			return parsedClusterSetName{}, false
+		}
 	}
-	
-	// Extract namespace and service
-	if len(parts) >= 5 {
-		namespace = parts[len(parts)-4] // fourth from the end
-		service = parts[len(parts)-5]    // fifth from the end
+
+	// <service>.<namespace>.svc.<cluster> — cluster-scoped.
+	if len(rest) < 4 || rest[len(rest)-2] != "svc" {
+		return parsedClusterSetName{}, false
 	}
-	
-	return service, namespace, true
+	cluster := rest[len(rest)-1]
+	namespace := rest[len(rest)-3]
+	service := rest[len(rest)-4]
+	if len(rest) != 4 {
+		// A label before <service> here would be a headless name within a
+		// cluster-scoped query; not supported yet.
+		return parsedClusterSetName{}, false
+	}
+	return parsedClusterSetName{Kind: queryKindClusterScoped, Service: service, Namespace: namespace, Cluster: cluster}, true
 }
 
-// findServiceNodes queries Headscale to find nodes matching the service and namespace
+// findServiceNodes queries Headscale to find nodes matching the service and namespace.
+//
+// The default identity vocabulary is Headscale ACL tags: a node backing
+// <service>.<namespace> is expected to carry
+// tag:mcs-<clusterset>-<namespace>-<service> (see serviceTag), which
+// findServiceNodes queries for directly instead of listing every node and
+// guessing from its name. Setting MatchMode to matchModeNamePrefix falls
+// back to that old substring heuristic for clusters that haven't tagged
+// their nodes yet.
 func (e K8sCross) findServiceNodes(ctx context.Context, service, namespace string) ([]*Node, error) {
-	// In a real implementation, this would query the Headscale API for nodes
-	// that match the service and namespace. For now, we'll simulate this by
-	// listing all nodes and filtering them.
-	// 
-	// In practice, you'd need to tag or label nodes in Headscale with service
-	// and namespace information, then query by those properties.
-	
-	nodes, err := e.HeadscaleClient.ListNodes(ctx, "")
+	if e.MatchMode == matchModeNamePrefix {
+		return e.findServiceNodesByNamePrefix(ctx, service, namespace)
+	}
+	return e.findServiceNodesByTag(ctx, service, namespace)
+}
+
+// defaultTagTemplate is the Go template serviceTag executes when TagTemplate
+// isn't set, reproducing the plugin's original tag:mcs-<clusterset>-
+// <namespace>-<service> vocabulary.
+const defaultTagTemplate = "tag:mcs-{{.ClusterSet}}-{{.Namespace}}-{{.Service}}"
+
+// tagTemplateData is the value serviceTag's template executes against.
+type tagTemplateData struct {
+	ClusterSet string
+	Namespace  string
+	Service    string
+}
+
+// parseTagTemplate parses a `tag_template` Corefile value. setup.go calls it
+// up front so a malformed template fails setup instead of every query.
+func parseTagTemplate(tmpl string) (*template.Template, error) {
+	return template.New("tag_template").Parse(tmpl)
+}
+
+// defaultTagTmpl is defaultTagTemplate, parsed once; defaultTagTemplate is a
+// fixed string known to parse, so a failure here is a bug, not a runtime
+// condition to handle.
+var defaultTagTmpl = template.Must(parseTagTemplate(defaultTagTemplate))
+
+// serviceTag returns the ACL tag that identifies nodes backing service in
+// namespace within this plugin's clusterset, by executing tagTmpl (or, if
+// that's nil, parsing TagTemplate/defaultTagTemplate on the spot).
+func (e K8sCross) serviceTag(service, namespace string) string {
+	tmpl := e.tagTmpl
+	if tmpl == nil {
+		tagTemplate := e.TagTemplate
+		if tagTemplate == "" {
+			tagTemplate = defaultTagTemplate
+		}
+		parsed, err := parseTagTemplate(tagTemplate)
+		if err != nil {
+			// TagTemplate was already validated by setup.go; this only
+			// happens for a literal built straight from an invalid
+			// TagTemplate value in a test, so fall back to the default
+			// rather than propagating a plumbing error through every
+			// caller of findServiceNodes.
+			parsed, _ = parseTagTemplate(defaultTagTemplate)
+		}
+		tmpl = parsed
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, tagTemplateData{ClusterSet: e.ClusterSet, Namespace: namespace, Service: service}); err != nil {
+		log.Errorf("serviceTag: executing tag_template: %v", err)
+		return fmt.Sprintf("tag:mcs-%s-%s-%s", e.ClusterSet, namespace, service)
+	}
+	return buf.String()
+}
+
+// findServiceNodesByTag returns the nodes carrying this service's tag, from
+// the Watcher's in-memory index if one is configured, falling back to a
+// direct (cached) Headscale ListNodesByTag call otherwise.
+func (e K8sCross) findServiceNodesByTag(ctx context.Context, service, namespace string) ([]*Node, error) {
+	tag := e.serviceTag(service, namespace)
+
+	var nodes []Node
+	if e.Watcher != nil {
+		matched, ok := e.Watcher.Lookup(tag)
+		if ok {
+			cacheHitsTotal.Inc()
+		} else {
+			cacheMissesTotal.Inc()
+		}
+		nodes = matched
+	} else {
+		var err error
+		err = instrumentHeadscale("list_nodes_by_tag", func() error {
+			var listErr error
+			nodes, listErr = e.HeadscaleClient.ListNodesByTag(ctx, tag)
+			return listErr
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	matchingNodes := make([]*Node, 0, len(nodes))
+	for i := range nodes {
+		matchingNodes = append(matchingNodes, &nodes[i])
+	}
+	return matchingNodes, nil
+}
+
+// findServiceNodesByNamePrefix is the legacy, best-effort compatibility mode:
+// it lists every node and matches by substring on the node name. It exists
+// behind `match_mode name-prefix` for operators migrating to tag-based
+// identity.
+func (e K8sCross) findServiceNodesByNamePrefix(ctx context.Context, service, namespace string) ([]*Node, error) {
+	var nodes []Node
+	err := instrumentHeadscale("list_nodes", func() error {
+		var listErr error
+		nodes, listErr = e.HeadscaleClient.ListNodes(ctx, "")
+		return listErr
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	// Filter nodes based on service and namespace (this would be done on the server side in a full implementation)
 	var matchingNodes []*Node
 	for i := range nodes {
 		node := &nodes[i]
-		// In a real implementation, you would filter based on actual service/namespace tags
-		// For now, we check if the node name contains both service and namespace
 		nodeName := strings.ToLower(node.Name)
 		if strings.Contains(nodeName, strings.ToLower(service)) && strings.Contains(nodeName, strings.ToLower(namespace)) {
 			matchingNodes = append(matchingNodes, node)
@@ -413,78 +836,171 @@ func (e K8sCross) findServiceNodes(ctx context.Context, service, namespace strin
 	return matchingNodes, nil
 }
 
-// buildARecords creates A records for the IP addresses of the nodes
+// answerFamily returns the configured answer-family policy, defaulting to
+// answerFamilyDual.
+func (e K8sCross) answerFamily() string {
+	if e.AnswerFamily == "" {
+		return answerFamilyDual
+	}
+	return e.AnswerFamily
+}
+
+// splitByFamily parses ipStrs and sorts the valid addresses into IPv4 and
+// IPv6 buckets, silently dropping anything that doesn't parse as an IP.
+func splitByFamily(ipStrs []string) (v4, v6 []net.IP) {
+	for _, s := range ipStrs {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			continue
+		}
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	return v4, v6
+}
+
+// buildARecords creates A records for the IPv4 addresses of the nodes,
+// honoring the configured answer-family policy: v6-only suppresses A
+// answers entirely, and prefer-v6 suppresses a node's v4 addresses when it
+// also has v6 ones.
 func (e K8sCross) buildARecords(nodes []*Node, service, namespace string) []dns.RR {
+	family := e.answerFamily()
+	if family == answerFamilyV6Only {
+		return nil
+	}
+
 	var records []dns.RR
-	
+	droppedForFamily := false
 	for _, node := range nodes {
-		for _, ipStr := range node.IPAddresses {
-			ip := net.ParseIP(ipStr)
-			if ip != nil && ip.To4() != nil { // IPv4 only
-				aRecord := &dns.A{
-					Hdr: dns.RR_Header{
-						Name:   fmt.Sprintf("%s.%s.svc.clusterset.local.", service, namespace),
-						Rrtype: dns.TypeA,
-						Class:  dns.ClassINET,
-						Ttl:    e.TTL,
-					},
-					A: ip,
-				}
-				records = append(records, aRecord)
-			}
+		v4, v6 := splitByFamily(node.IPAddresses)
+		if family == answerFamilyPreferV6 && len(v6) > 0 {
+			droppedForFamily = droppedForFamily || len(v4) > 0
+			continue
+		}
+		for _, ip := range v4 {
+			records = append(records, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   fmt.Sprintf("%s.%s.svc.clusterset.local.", service, namespace),
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    e.TTL,
+				},
+				A: ip,
+			})
 		}
 	}
-	
+
+	if len(records) == 0 && droppedForFamily {
+		log.Debugf("no A records for %s.%s: answer_family=%s prefers IPv6 and every node has it", service, namespace, family)
+	}
 	return records
 }
 
-// buildAAAARecords creates AAAA records for the IP addresses of the nodes
+// buildAAAARecords creates AAAA records for the IPv6 addresses of the
+// nodes, honoring the configured answer-family policy symmetrically to
+// buildARecords.
 func (e K8sCross) buildAAAARecords(nodes []*Node, service, namespace string) []dns.RR {
+	family := e.answerFamily()
+	if family == answerFamilyV4Only {
+		return nil
+	}
+
 	var records []dns.RR
-	
+	droppedForFamily := false
 	for _, node := range nodes {
-		for _, ipStr := range node.IPAddresses {
-			ip := net.ParseIP(ipStr)
-			if ip != nil && ip.To4() == nil { // IPv6 only
-				aaaaRecord := &dns.AAAA{
-					Hdr: dns.RR_Header{
-						Name:   fmt.Sprintf("%s.%s.svc.clusterset.local.", service, namespace),
-						Rrtype: dns.TypeAAAA,
-						Class:  dns.ClassINET,
-						Ttl:    e.TTL,
-					},
-					AAAA: ip,
-				}
-				records = append(records, aaaaRecord)
-			}
+		v4, v6 := splitByFamily(node.IPAddresses)
+		if family == answerFamilyPreferV4 && len(v4) > 0 {
+			droppedForFamily = droppedForFamily || len(v6) > 0
+			continue
+		}
+		for _, ip := range v6 {
+			records = append(records, &dns.AAAA{
+				Hdr: dns.RR_Header{
+					Name:   fmt.Sprintf("%s.%s.svc.clusterset.local.", service, namespace),
+					Rrtype: dns.TypeAAAA,
+					Class:  dns.ClassINET,
+					Ttl:    e.TTL,
+				},
+				AAAA: ip,
+			})
 		}
 	}
-	
+
+	if len(records) == 0 && droppedForFamily {
+		log.Debugf("no AAAA records for %s.%s: answer_family=%s prefers IPv4 and every node has it", service, namespace, family)
+	}
 	return records
 }
 
-// buildSRVRecords creates SRV records for the service
+// buildSRVRecords creates SRV records for the service, using the port/proto/
+// name configured for it via SRVPorts (the `srv_port` Corefile directive), or
+// defaultSRVPort if it has no entry there.
 func (e K8sCross) buildSRVRecords(nodes []*Node, service, namespace string) []dns.RR {
 	var records []dns.RR
-	
+
+	port := defaultSRVPort
+	if p, ok := e.SRVPorts[srvPortKey(namespace, service)]; ok {
+		port = p
+	}
+
 	// SRV records follow the format _service._proto.name. TTL class SRV priority weight port target
 	// For the service, we create one SRV record regardless of the number of nodes
 	if len(nodes) > 0 {
 		srvRecord := &dns.SRV{
 			Hdr: dns.RR_Header{
-				Name:   fmt.Sprintf("_http._tcp.%s.%s.svc.clusterset.local.", service, namespace),
+				Name:   fmt.Sprintf("_%s._%s.%s.%s.svc.clusterset.local.", port.Name, port.Proto, service, namespace),
 				Rrtype: dns.TypeSRV,
 				Class:  dns.ClassINET,
 				Ttl:    e.TTL,
 			},
 			Priority: 10,
 			Weight:   10,
-			Port:     80,
+			Port:     port.Port,
 			Target:   fmt.Sprintf("%s.%s.svc.clusterset.local.", service, namespace),
 		}
 		records = append(records, srvRecord)
 	}
-	
+
+	return records
+}
+
+// buildSRVRecordsFromEndpoints creates one SRV record per port on each
+// ClusterEndpoint, using the real ports reported on the backing EndpointSlice
+// instead of the hardcoded _http._tcp/80 that buildSRVRecords falls back to
+// when no MCS index is available.
+func (e K8sCross) buildSRVRecordsFromEndpoints(endpoints []mcs.ClusterEndpoint, service, namespace string) []dns.RR {
+	var records []dns.RR
+
+	target := fmt.Sprintf("%s.%s.svc.clusterset.local.", service, namespace)
+	for _, ep := range endpoints {
+		for _, port := range ep.Ports {
+			proto := strings.ToLower(port.Protocol)
+			if proto == "" {
+				proto = "tcp"
+			}
+			name := port.Name
+			if name == "" {
+				name = "default"
+			}
+
+			records = append(records, &dns.SRV{
+				Hdr: dns.RR_Header{
+					Name:   fmt.Sprintf("_%s._%s.%s", name, proto, target),
+					Rrtype: dns.TypeSRV,
+					Class:  dns.ClassINET,
+					Ttl:    e.TTL,
+				},
+				Priority: 10,
+				Weight:   10,
+				Port:     uint16(port.Port),
+				Target:   target,
+			})
+		}
+	}
+
 	return records
 }
 
@@ -3,13 +3,17 @@ package k8s_cross
 import (
 	"context"
 	"fmt"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/coredns/coredns/plugin/pkg/dnstest"
 	"github.com/coredns/coredns/plugin/test"
 	"github.com/miekg/dns"
 
 	"github.com/wold9168/k8s_cross/headscale"
+	"github.com/wold9168/k8s_cross/headscale/watch"
+	"github.com/wold9168/k8s_cross/mcs"
 )
 
 // TestK8sCross tests the k8s_cross plugin's basic functionality
@@ -61,33 +65,72 @@ func TestK8sCross_ParseClusterSetDomain(t *testing.T) {
 	x := K8sCross{}
 
 	// Test valid clusterset domain
-	service, namespace, valid := x.parseClusterSetDomain("my-service.my-namespace.svc.clusterset.local.")
+	parsed, valid := x.parseClusterSetDomain("my-service.my-namespace.svc.clusterset.local.")
 	if !valid {
 		t.Error("Expected valid domain, got invalid")
 	}
-	if service != "my-service" {
-		t.Errorf("Expected service 'my-service', got '%s'", service)
+	if parsed.Kind != queryKindService {
+		t.Errorf("Expected queryKindService, got %v", parsed.Kind)
 	}
-	if namespace != "my-namespace" {
-		t.Errorf("Expected namespace 'my-namespace', got '%s'", namespace)
+	if parsed.Service != "my-service" {
+		t.Errorf("Expected service 'my-service', got '%s'", parsed.Service)
+	}
+	if parsed.Namespace != "my-namespace" {
+		t.Errorf("Expected namespace 'my-namespace', got '%s'", parsed.Namespace)
 	}
 
 	// Test invalid domain
-	_, _, valid = x.parseClusterSetDomain("invalid.domain.com.")
+	_, valid = x.parseClusterSetDomain("invalid.domain.com.")
 	if valid {
 		t.Error("Expected invalid domain, got valid")
 	}
 
 	// Test domain with trailing dot
-	service, namespace, valid = x.parseClusterSetDomain("service.namespace.svc.clusterset.local.")
+	parsed, valid = x.parseClusterSetDomain("service.namespace.svc.clusterset.local.")
 	if !valid {
 		t.Error("Expected valid domain, got invalid")
 	}
-	if service != "service" {
-		t.Errorf("Expected service 'service', got '%s'", service)
+	if parsed.Service != "service" {
+		t.Errorf("Expected service 'service', got '%s'", parsed.Service)
+	}
+	if parsed.Namespace != "namespace" {
+		t.Errorf("Expected namespace 'namespace', got '%s'", parsed.Namespace)
+	}
+}
+
+// TestK8sCross_ParseClusterSetDomain_ClusterScoped tests the
+// <service>.<namespace>.svc.<cluster>.clusterset.local shape.
+func TestK8sCross_ParseClusterSetDomain_ClusterScoped(t *testing.T) {
+	x := K8sCross{}
+
+	parsed, valid := x.parseClusterSetDomain("my-service.my-namespace.svc.eu1.clusterset.local.")
+	if !valid {
+		t.Fatal("Expected valid domain, got invalid")
+	}
+	if parsed.Kind != queryKindClusterScoped {
+		t.Errorf("Expected queryKindClusterScoped, got %v", parsed.Kind)
 	}
-	if namespace != "namespace" {
-		t.Errorf("Expected namespace 'namespace', got '%s'", namespace)
+	if parsed.Service != "my-service" || parsed.Namespace != "my-namespace" || parsed.Cluster != "eu1" {
+		t.Errorf("Expected service/namespace/cluster my-service/my-namespace/eu1, got %s/%s/%s",
+			parsed.Service, parsed.Namespace, parsed.Cluster)
+	}
+}
+
+// TestK8sCross_ParseClusterSetDomain_Headless tests the
+// <hostname>.<service>.<namespace>.svc.clusterset.local shape.
+func TestK8sCross_ParseClusterSetDomain_Headless(t *testing.T) {
+	x := K8sCross{}
+
+	parsed, valid := x.parseClusterSetDomain("pod-0.my-service.my-namespace.svc.clusterset.local.")
+	if !valid {
+		t.Fatal("Expected valid domain, got invalid")
+	}
+	if parsed.Kind != queryKindHeadless {
+		t.Errorf("Expected queryKindHeadless, got %v", parsed.Kind)
+	}
+	if parsed.Service != "my-service" || parsed.Namespace != "my-namespace" || parsed.Hostname != "pod-0" {
+		t.Errorf("Expected service/namespace/hostname my-service/my-namespace/pod-0, got %s/%s/%s",
+			parsed.Service, parsed.Namespace, parsed.Hostname)
 	}
 }
 
@@ -112,9 +155,21 @@ func TestK8sCross_IsClustersetQuery(t *testing.T) {
 	}
 }
 
+// stubMCS is a minimal MCSLookup that never matches anything; tests use it
+// only to mark MCS as configured so reverse-zone matching isn't gated off.
+type stubMCS struct{}
+
+func (stubMCS) Lookup(namespace, service string) ([]mcs.ClusterEndpoint, bool) { return nil, false }
+
 // MockHeadscaleClient is a mock implementation of the Headscale client for testing
 type MockHeadscaleClient struct {
 	Nodes []headscale.Node
+
+	// HealthResponse and HealthErr, if set, override Health's default
+	// always-healthy result. Tests use these to simulate Headscale being
+	// unreachable or reporting a broken database.
+	HealthResponse *headscale.HealthResponse
+	HealthErr      error
 }
 
 func (m *MockHeadscaleClient) GetNode(ctx context.Context, nodeId string) (*headscale.Node, error) {
@@ -132,7 +187,23 @@ func (m *MockHeadscaleClient) ListNodes(ctx context.Context, userFilter string)
 	return m.Nodes, nil
 }
 
+func (m *MockHeadscaleClient) ListNodesByTag(ctx context.Context, tag string) ([]headscale.Node, error) {
+	var matching []headscale.Node
+	for _, node := range m.Nodes {
+		if node.HasTag(tag) {
+			matching = append(matching, node)
+		}
+	}
+	return matching, nil
+}
+
 func (m *MockHeadscaleClient) Health(ctx context.Context) (*headscale.HealthResponse, error) {
+	if m.HealthErr != nil {
+		return nil, m.HealthErr
+	}
+	if m.HealthResponse != nil {
+		return m.HealthResponse, nil
+	}
 	return &headscale.HealthResponse{DatabaseConnectivity: true}, nil
 }
 
@@ -140,6 +211,20 @@ func (m *MockHeadscaleClient) CreateUser(ctx context.Context, req *headscale.Cre
 	return nil, nil
 }
 
+func (m *MockHeadscaleClient) CreatePreAuthKey(ctx context.Context, user string, tags []string, expiry time.Time) (*headscale.PreAuthKey, error) {
+	return &headscale.PreAuthKey{User: user, Tags: tags, Expiration: expiry}, nil
+}
+
+func (m *MockHeadscaleClient) SetNodeTags(ctx context.Context, nodeId string, tags []string) error {
+	for i := range m.Nodes {
+		if m.Nodes[i].ID == nodeId {
+			m.Nodes[i].ForcedTags = tags
+			return nil
+		}
+	}
+	return fmt.Errorf("node not found")
+}
+
 // TestK8sCross_FindServiceNodes tests the service node discovery functionality
 func TestK8sCross_FindServiceNodes(t *testing.T) {
 	// Create mock nodes
@@ -162,6 +247,7 @@ func TestK8sCross_FindServiceNodes(t *testing.T) {
 
 	x := K8sCross{
 		HeadscaleClient: mockClient,
+		MatchMode:       matchModeNamePrefix,
 	}
 
 	// Find nodes matching "my-service"
@@ -179,6 +265,219 @@ func TestK8sCross_FindServiceNodes(t *testing.T) {
 	}
 }
 
+// TestK8sCross_FindServiceNodesByTag tests the default, tag-based service
+// node discovery mode.
+func TestK8sCross_FindServiceNodesByTag(t *testing.T) {
+	mockNodes := []headscale.Node{
+		{ID: "1", Name: "node1", ForcedTags: []string{"tag:mcs-test-clusterset-my-namespace-my-service"}},
+		{ID: "2", Name: "node2", ForcedTags: []string{"tag:mcs-test-clusterset-my-namespace-other-service"}},
+	}
+
+	mockClient := &MockHeadscaleClient{Nodes: mockNodes}
+
+	x := K8sCross{
+		HeadscaleClient: mockClient,
+		ClusterSet:      "test-clusterset",
+	}
+
+	nodes, err := x.findServiceNodes(context.Background(), "my-service", "my-namespace")
+	if err != nil {
+		t.Errorf("Error finding service nodes: %v", err)
+	}
+
+	if len(nodes) != 1 {
+		t.Fatalf("Expected 1 matching node, got %d", len(nodes))
+	}
+	if nodes[0].Name != "node1" {
+		t.Errorf("Expected 'node1', got '%s'", nodes[0].Name)
+	}
+}
+
+// TestK8sCross_FindServiceNodesByTag_CustomTemplate verifies that a
+// TagTemplate override replaces the default tag:mcs-... vocabulary.
+func TestK8sCross_FindServiceNodesByTag_CustomTemplate(t *testing.T) {
+	mockNodes := []headscale.Node{
+		{ID: "1", Name: "node1", ForcedTags: []string{"tag:svc-my-service"}},
+		{ID: "2", Name: "node2", ForcedTags: []string{"tag:svc-other-service"}},
+	}
+
+	mockClient := &MockHeadscaleClient{Nodes: mockNodes}
+
+	x := K8sCross{
+		HeadscaleClient: mockClient,
+		ClusterSet:      "test-clusterset",
+		TagTemplate:     "tag:svc-{{.Service}}",
+	}
+
+	nodes, err := x.findServiceNodes(context.Background(), "my-service", "my-namespace")
+	if err != nil {
+		t.Errorf("Error finding service nodes: %v", err)
+	}
+
+	if len(nodes) != 1 {
+		t.Fatalf("Expected 1 matching node, got %d", len(nodes))
+	}
+	if nodes[0].Name != "node1" {
+		t.Errorf("Expected 'node1', got '%s'", nodes[0].Name)
+	}
+}
+
+// TestK8sCross_FindServiceNodesByTag_UsesWatcher verifies that a configured
+// Watcher answers findServiceNodes from its in-memory index instead of
+// calling HeadscaleClient.ListNodesByTag.
+func TestK8sCross_FindServiceNodesByTag_UsesWatcher(t *testing.T) {
+	mockClient := &MockHeadscaleClient{Nodes: []headscale.Node{
+		{ID: "1", Name: "stale-node", ForcedTags: []string{"tag:mcs-test-clusterset-my-namespace-my-service"}},
+	}}
+
+	w := watch.NewWatcher(mockClient, "http://headscale.test", time.Minute)
+	w.Push([]headscale.Node{
+		{ID: "2", Name: "watched-node", ForcedTags: []string{"tag:mcs-test-clusterset-my-namespace-my-service"}},
+	})
+
+	x := K8sCross{
+		HeadscaleClient: mockClient,
+		ClusterSet:      "test-clusterset",
+		Watcher:         w,
+	}
+
+	nodes, err := x.findServiceNodes(context.Background(), "my-service", "my-namespace")
+	if err != nil {
+		t.Errorf("Error finding service nodes: %v", err)
+	}
+	if len(nodes) != 1 || nodes[0].Name != "watched-node" {
+		t.Errorf("expected the watcher's pushed node, got %+v", nodes)
+	}
+}
+
+// TestK8sCross_ReverseNameToIP tests decoding in-addr.arpa and ip6.arpa
+// question names back into the IP addresses they encode.
+func TestK8sCross_ReverseNameToIP(t *testing.T) {
+	ip := reverseNameToIP("1.0.0.10.in-addr.arpa.")
+	if ip == nil || ip.String() != "10.0.0.1" {
+		t.Errorf("expected 10.0.0.1, got %v", ip)
+	}
+
+	ip = reverseNameToIP("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.")
+	if ip == nil || ip.String() != "2001:db8::1" {
+		t.Errorf("expected 2001:db8::1, got %v", ip)
+	}
+
+	if ip := reverseNameToIP("my-service.my-namespace.svc.clusterset.local."); ip != nil {
+		t.Errorf("expected nil for a non-reverse name, got %v", ip)
+	}
+}
+
+// TestK8sCross_IsClustersetQuery_Reverse tests that isClustersetQuery also
+// matches PTR queries whose address falls within a configured reverse zone.
+func TestK8sCross_IsClustersetQuery_Reverse(t *testing.T) {
+	_, zone, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("ParseCIDR: %v", err)
+	}
+	x := K8sCross{Zones: []string{"clusterset.local"}, ReverseZones: []*net.IPNet{zone}, MCS: stubMCS{}}
+
+	if !x.isClustersetQuery("1.0.0.10.in-addr.arpa.") {
+		t.Error("expected PTR query within the reverse zone to match")
+	}
+	if x.isClustersetQuery("1.0.0.192.in-addr.arpa.") {
+		t.Error("expected PTR query outside the reverse zone to not match")
+	}
+}
+
+// TestK8sCross_IsClustersetQuery_ReverseWithoutMCS tests that a reverse zone
+// is never claimed without MCS configured, since nothing would ever populate
+// reverseIdx in that deployment mode.
+func TestK8sCross_IsClustersetQuery_ReverseWithoutMCS(t *testing.T) {
+	_, zone, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("ParseCIDR: %v", err)
+	}
+	x := K8sCross{Zones: []string{"clusterset.local"}, ReverseZones: []*net.IPNet{zone}}
+
+	if x.isClustersetQuery("1.0.0.10.in-addr.arpa.") {
+		t.Error("expected PTR query to not match a reverse zone without MCS configured")
+	}
+}
+
+// TestK8sCross_HandlePTRQuery tests that a PTR query resolves through the
+// reverse index populated by rebuildReverseIndex.
+func TestK8sCross_HandlePTRQuery(t *testing.T) {
+	_, zone, _ := net.ParseCIDR("10.0.0.0/8")
+	x := K8sCross{
+		TTL:          300,
+		Zones:        []string{"clusterset.local"},
+		ReverseZones: []*net.IPNet{zone},
+		reverseIdx:   newReverseIndex(),
+		MCS:          stubMCS{},
+	}
+	x.reverseIdx.replace(map[string]string{"10.0.0.1": "my-service.my-namespace.svc.clusterset.local."})
+
+	ctx := context.Background()
+	r := new(dns.Msg)
+	r.SetQuestion("1.0.0.10.in-addr.arpa.", dns.TypePTR)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+	if _, err := x.ServeDNS(ctx, rec, r); err != nil {
+		t.Fatalf("Error handling PTR request: %v", err)
+	}
+
+	if rec.Msg == nil || rec.Msg.Rcode != dns.RcodeSuccess || len(rec.Msg.Answer) != 1 {
+		t.Fatalf("expected one PTR answer, got %+v", rec.Msg)
+	}
+	ptr, ok := rec.Msg.Answer[0].(*dns.PTR)
+	if !ok || ptr.Ptr != "my-service.my-namespace.svc.clusterset.local." {
+		t.Errorf("unexpected PTR answer: %+v", rec.Msg.Answer[0])
+	}
+}
+
+// TestK8sCross_AnswerFamilyPolicy tests that buildARecords/buildAAAARecords
+// honor the configured answer-family policy for dual-stack nodes.
+func TestK8sCross_AnswerFamilyPolicy(t *testing.T) {
+	dualStack := []*headscale.Node{
+		{ID: "1", Name: "dual-stack-node", IPAddresses: []string{"10.0.0.1", "2001:db8::1"}},
+	}
+	v6Only := []*headscale.Node{
+		{ID: "2", Name: "v6-only-node", IPAddresses: []string{"2001:db8::2"}},
+	}
+
+	// dual (default): both families answered independently.
+	x := K8sCross{TTL: 300}
+	if got := len(x.buildARecords(dualStack, "svc", "ns")); got != 1 {
+		t.Errorf("dual: expected 1 A record, got %d", got)
+	}
+	if got := len(x.buildAAAARecords(dualStack, "svc", "ns")); got != 1 {
+		t.Errorf("dual: expected 1 AAAA record, got %d", got)
+	}
+
+	// prefer-v6: a dual-stack node's v4 address is suppressed in favor of v6.
+	x = K8sCross{TTL: 300, AnswerFamily: answerFamilyPreferV6}
+	if got := len(x.buildARecords(dualStack, "svc", "ns")); got != 0 {
+		t.Errorf("prefer-v6: expected 0 A records for dual-stack node, got %d", got)
+	}
+	if got := len(x.buildAAAARecords(dualStack, "svc", "ns")); got != 1 {
+		t.Errorf("prefer-v6: expected 1 AAAA record, got %d", got)
+	}
+
+	// prefer-v4: a v6-only node still gets answered, since v4 isn't available.
+	x = K8sCross{TTL: 300, AnswerFamily: answerFamilyPreferV4}
+	if got := len(x.buildAAAARecords(v6Only, "svc", "ns")); got != 1 {
+		t.Errorf("prefer-v4: expected v6-only node to still get an AAAA record, got %d", got)
+	}
+
+	// v4-only: AAAA is never answered, even for a v6-only node.
+	x = K8sCross{TTL: 300, AnswerFamily: answerFamilyV4Only}
+	if got := len(x.buildAAAARecords(v6Only, "svc", "ns")); got != 0 {
+		t.Errorf("v4-only: expected 0 AAAA records, got %d", got)
+	}
+
+	// v6-only: A is never answered, even for a dual-stack node.
+	x = K8sCross{TTL: 300, AnswerFamily: answerFamilyV6Only}
+	if got := len(x.buildARecords(dualStack, "svc", "ns")); got != 0 {
+		t.Errorf("v6-only: expected 0 A records, got %d", got)
+	}
+}
+
 // TestK8sCross_BuildRecords tests the DNS record building functionality
 func TestK8sCross_BuildRecords(t *testing.T) {
 	nodes := []*headscale.Node{
@@ -207,3 +506,121 @@ func TestK8sCross_BuildRecords(t *testing.T) {
 		t.Errorf("Expected AAAA record type, got %d", aaaaRecords[0].Header().Rrtype)
 	}
 }
+
+// TestK8sCross_BuildSRVRecords tests that buildSRVRecords falls back to
+// defaultSRVPort for a service with no SRVPorts entry, and otherwise uses the
+// port/proto/name the `srv_port` directive configured for it.
+func TestK8sCross_BuildSRVRecords(t *testing.T) {
+	nodes := []*headscale.Node{{ID: "1", Name: "my-service-1", IPAddresses: []string{"10.0.0.1"}}}
+
+	x := K8sCross{TTL: 300}
+	records := x.buildSRVRecords(nodes, "test-service", "test-namespace")
+	if len(records) != 1 {
+		t.Fatalf("expected 1 SRV record, got %d", len(records))
+	}
+	srv := records[0].(*dns.SRV)
+	if srv.Hdr.Name != "_http._tcp.test-service.test-namespace.svc.clusterset.local." || srv.Port != 80 {
+		t.Errorf("expected the default _http._tcp/80 record, got %+v", srv)
+	}
+
+	x.SRVPorts = map[string]srvPort{
+		srvPortKey("test-namespace", "test-service"): {Port: 9090, Proto: "tcp", Name: "metrics"},
+	}
+	records = x.buildSRVRecords(nodes, "test-service", "test-namespace")
+	srv = records[0].(*dns.SRV)
+	if srv.Hdr.Name != "_metrics._tcp.test-service.test-namespace.svc.clusterset.local." || srv.Port != 9090 {
+		t.Errorf("expected the configured _metrics._tcp/9090 record, got %+v", srv)
+	}
+}
+
+// countingHandler is a synthetic next plugin.Handler that records whether it
+// was invoked, for asserting on fallthrough behavior.
+type countingHandler struct {
+	called bool
+}
+
+func (h *countingHandler) Name() string { return "counting" }
+
+func (h *countingHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	h.called = true
+	return dns.RcodeSuccess, nil
+}
+
+// TestK8sCross_Fallthrough_NoMatch verifies that a query for a service with
+// no backing nodes is passed to the next plugin when fallthrough covers its
+// zone, instead of being answered with an empty record set.
+func TestK8sCross_Fallthrough_NoMatch(t *testing.T) {
+	next := &countingHandler{}
+	x := K8sCross{
+		Next:            next,
+		HeadscaleClient: &MockHeadscaleClient{},
+		Zones:           []string{"clusterset.local"},
+		ClusterSet:      "test-clusterset",
+		Fallthrough:     fallthroughConfig{enabled: true},
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion("missing-service.my-namespace.svc.clusterset.local.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+	if _, err := x.ServeDNS(context.Background(), rec, r); err != nil {
+		t.Fatalf("ServeDNS: %v", err)
+	}
+
+	if !next.called {
+		t.Error("expected the next plugin to be invoked for a zero-match query with fallthrough enabled")
+	}
+}
+
+// TestK8sCross_Fallthrough_Disabled verifies that without fallthrough
+// configured, a zero-match query is still answered here (empty record set)
+// rather than passed on.
+func TestK8sCross_Fallthrough_Disabled(t *testing.T) {
+	next := &countingHandler{}
+	x := K8sCross{
+		Next:            next,
+		HeadscaleClient: &MockHeadscaleClient{},
+		Zones:           []string{"clusterset.local"},
+		ClusterSet:      "test-clusterset",
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion("missing-service.my-namespace.svc.clusterset.local.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+	if _, err := x.ServeDNS(context.Background(), rec, r); err != nil {
+		t.Fatalf("ServeDNS: %v", err)
+	}
+
+	if next.called {
+		t.Error("expected the next plugin not to be invoked when fallthrough isn't configured")
+	}
+	if rec.Msg == nil || len(rec.Msg.Answer) != 0 {
+		t.Errorf("expected an empty answer set, got %+v", rec.Msg)
+	}
+}
+
+// TestK8sCross_Fallthrough_ZoneFilter verifies that naming zones in the
+// fallthrough directive restricts it to just those zones.
+func TestK8sCross_Fallthrough_ZoneFilter(t *testing.T) {
+	next := &countingHandler{}
+	x := K8sCross{
+		Next:            next,
+		HeadscaleClient: &MockHeadscaleClient{},
+		Zones:           []string{"clusterset.local"},
+		ClusterSet:      "test-clusterset",
+		Fallthrough:     fallthroughConfig{enabled: true, zones: []string{"other.local"}},
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion("missing-service.my-namespace.svc.clusterset.local.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+	if _, err := x.ServeDNS(context.Background(), rec, r); err != nil {
+		t.Fatalf("ServeDNS: %v", err)
+	}
+
+	if next.called {
+		t.Error("expected the next plugin not to be invoked for a zone not covered by fallthrough")
+	}
+}
@@ -0,0 +1,246 @@
+// Package mcs implements a client-go informer-backed controller for the
+// Kubernetes Multi-Cluster Services API (KEP-1645). It watches ServiceImport
+// and EndpointSlice resources labeled for multi-cluster service export and
+// maintains an in-memory index that the k8s_cross plugin queries on the DNS
+// hot path instead of talking to Headscale directly.
+package mcs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+
+	mcsv1alpha1 "sigs.k8s.io/mcs-api/pkg/apis/v1alpha1"
+	mcsclientset "sigs.k8s.io/mcs-api/pkg/client/clientset/versioned"
+	mcsinformers "sigs.k8s.io/mcs-api/pkg/client/informers/externalversions"
+)
+
+// ServiceNameLabel is the EndpointSlice label that ties a slice back to the
+// ServiceImport it backs, per KEP-1645.
+const ServiceNameLabel = "multicluster.kubernetes.io/service-name"
+
+// PortInfo describes one exported port of a multi-cluster service endpoint.
+type PortInfo struct {
+	Name     string
+	Port     int32
+	Protocol string
+}
+
+// ClusterEndpoint is one cluster's contribution to a multi-cluster service:
+// the set of addresses, ports and (for headless services) the hostname that
+// back it in that cluster.
+type ClusterEndpoint struct {
+	ClusterID string
+	IPs       []string
+	Ports     []PortInfo
+	Hostname  string
+}
+
+// Lookup is the read-only view of the index that the k8s_cross plugin
+// consumes. It is satisfied by *Controller; tests can substitute a fake.
+type Lookup interface {
+	Lookup(namespace, service string) ([]ClusterEndpoint, bool)
+}
+
+// Controller watches ServiceImport and EndpointSlice objects and keeps a
+// thread-safe index of <namespace>/<service> -> []ClusterEndpoint up to date.
+type Controller struct {
+	kubeClient kubernetes.Interface
+	mcsClient  mcsclientset.Interface
+
+	informerFactory    informers.SharedInformerFactory
+	mcsInformerFactory mcsinformers.SharedInformerFactory
+
+	mu    sync.RWMutex
+	index map[string][]ClusterEndpoint
+
+	stopCh chan struct{}
+}
+
+// NewController builds a Controller from a rest.Config. Callers typically
+// obtain the config from InClusterConfig or a kubeconfig file; see setup.go.
+func NewController(config *rest.Config) (*Controller, error) {
+	kubeClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("building kubernetes client: %w", err)
+	}
+
+	mcsClient, err := mcsclientset.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("building mcs-api client: %w", err)
+	}
+
+	return &Controller{
+		kubeClient: kubeClient,
+		mcsClient:  mcsClient,
+		index:      make(map[string][]ClusterEndpoint),
+		stopCh:     make(chan struct{}),
+	}, nil
+}
+
+// Start begins the informers and blocks until the initial cache sync
+// completes. Call Stop to tear everything down.
+func (c *Controller) Start(ctx context.Context) error {
+	c.informerFactory = informers.NewSharedInformerFactory(c.kubeClient, 0)
+	c.mcsInformerFactory = mcsinformers.NewSharedInformerFactory(c.mcsClient, 0)
+
+	epInformer := c.informerFactory.Discovery().V1().EndpointSlices().Informer()
+	epInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.onEndpointSliceChanged(obj) },
+		UpdateFunc: func(_, obj interface{}) { c.onEndpointSliceChanged(obj) },
+		DeleteFunc: func(obj interface{}) { c.onEndpointSliceChanged(obj) },
+	})
+
+	siInformer := c.mcsInformerFactory.Multicluster().V1alpha1().ServiceImports().Informer()
+	siInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.onServiceImportChanged(obj) },
+		UpdateFunc: func(_, obj interface{}) { c.onServiceImportChanged(obj) },
+		DeleteFunc: func(obj interface{}) { c.onServiceImportChanged(obj) },
+	})
+
+	c.informerFactory.Start(c.stopCh)
+	c.mcsInformerFactory.Start(c.stopCh)
+
+	if !cache.WaitForCacheSync(c.stopCh, epInformer.HasSynced, siInformer.HasSynced) {
+		return fmt.Errorf("mcs: timed out waiting for informer caches to sync")
+	}
+
+	return nil
+}
+
+// Stop shuts down the informers started by Start.
+func (c *Controller) Stop() {
+	close(c.stopCh)
+}
+
+// Lookup returns the ClusterEndpoints currently known for <namespace>/<service>.
+func (c *Controller) Lookup(namespace, service string) ([]ClusterEndpoint, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	eps, ok := c.index[indexKey(namespace, service)]
+	return eps, ok
+}
+
+// ServiceKey identifies one indexed multi-cluster service.
+type ServiceKey struct {
+	Namespace string
+	Service   string
+}
+
+// Services returns the namespace/service pairs currently present in the
+// index, for callers (such as the tag reconciler) that need to walk every
+// known service rather than look one up.
+func (c *Controller) Services() []ServiceKey {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	keys := make([]ServiceKey, 0, len(c.index))
+	for k := range c.index {
+		namespace, service, _ := splitIndexKey(k)
+		keys = append(keys, ServiceKey{Namespace: namespace, Service: service})
+	}
+	return keys
+}
+
+// onEndpointSliceChanged rebuilds the index entry for whichever service the
+// changed EndpointSlice (identified by the service-name label) belongs to.
+func (c *Controller) onEndpointSliceChanged(obj interface{}) {
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		return
+	}
+
+	svcName, ok := slice.Labels[ServiceNameLabel]
+	if !ok {
+		return
+	}
+
+	c.rebuildIndex(slice.Namespace, svcName)
+}
+
+// onServiceImportChanged rebuilds the index entry for the namespace/name of
+// the ServiceImport that triggered the informer callback.
+func (c *Controller) onServiceImportChanged(obj interface{}) {
+	si, ok := obj.(*mcsv1alpha1.ServiceImport)
+	if !ok {
+		return
+	}
+
+	c.rebuildIndex(si.Namespace, si.Name)
+}
+
+// rebuildIndex recomputes the ClusterEndpoint list for namespace/service from
+// the current EndpointSlice informer cache and stores it in the index.
+func (c *Controller) rebuildIndex(namespace, service string) {
+	selector := labels.SelectorFromSet(labels.Set{ServiceNameLabel: service})
+	slices, err := c.informerFactory.Discovery().V1().EndpointSlices().
+		Lister().EndpointSlices(namespace).List(selector)
+	if err != nil {
+		return
+	}
+
+	eps := make([]ClusterEndpoint, 0, len(slices))
+	for _, slice := range slices {
+		clusterID := slice.Labels["multicluster.kubernetes.io/source-cluster"]
+		for _, ep := range slice.Endpoints {
+			ce := ClusterEndpoint{
+				ClusterID: clusterID,
+				IPs:       ep.Addresses,
+				Ports:     portsFromSlice(slice.Ports),
+			}
+			if ep.Hostname != nil {
+				ce.Hostname = *ep.Hostname
+			}
+			eps = append(eps, ce)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(eps) == 0 {
+		delete(c.index, indexKey(namespace, service))
+		return
+	}
+	c.index[indexKey(namespace, service)] = eps
+}
+
+func portsFromSlice(ports []discoveryv1.EndpointPort) []PortInfo {
+	out := make([]PortInfo, 0, len(ports))
+	for _, p := range ports {
+		pi := PortInfo{}
+		if p.Name != nil {
+			pi.Name = *p.Name
+		}
+		if p.Port != nil {
+			pi.Port = *p.Port
+		}
+		if p.Protocol != nil {
+			pi.Protocol = string(*p.Protocol)
+		}
+		out = append(out, pi)
+	}
+	return out
+}
+
+func indexKey(namespace, service string) string {
+	return namespace + "/" + service
+}
+
+// splitIndexKey reverses indexKey. Namespace and service names cannot
+// contain "/", so a single split is unambiguous.
+func splitIndexKey(k string) (namespace, service string, ok bool) {
+	for i := 0; i < len(k); i++ {
+		if k[i] == '/' {
+			return k[:i], k[i+1:], true
+		}
+	}
+	return "", "", false
+}
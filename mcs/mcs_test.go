@@ -0,0 +1,166 @@
+package mcs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+// strPtr/int32Ptr/protoPtr mirror the pointer-to-scalar fields the
+// EndpointSlice API expects.
+func strPtr(s string) *string                     { return &s }
+func int32Ptr(i int32) *int32                     { return &i }
+func protoPtr(p corev1.Protocol) *corev1.Protocol { return &p }
+
+// endpointSlice builds a minimal EndpointSlice for namespace/service backed
+// by clusterID, with one endpoint per address in ips.
+func endpointSlice(name, namespace, service, clusterID string, ips ...string) *discoveryv1.EndpointSlice {
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels: map[string]string{
+				ServiceNameLabel: service,
+				"multicluster.kubernetes.io/source-cluster": clusterID,
+			},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Ports: []discoveryv1.EndpointPort{
+			{Name: strPtr("http"), Port: int32Ptr(80), Protocol: protoPtr(corev1.ProtocolTCP)},
+		},
+	}
+	for _, ip := range ips {
+		slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{Addresses: []string{ip}})
+	}
+	return slice
+}
+
+// newTestController builds a Controller whose informerFactory is backed by a
+// fake clientset seeded with slices, synced and ready for rebuildIndex to
+// read from without needing a real API server.
+func newTestController(t *testing.T, slices ...*discoveryv1.EndpointSlice) (*Controller, chan struct{}) {
+	t.Helper()
+
+	clientset := fake.NewSimpleClientset()
+	for _, s := range slices {
+		if _, err := clientset.DiscoveryV1().EndpointSlices(s.Namespace).Create(context.Background(), s, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("seeding endpointslice: %v", err)
+		}
+	}
+
+	c := &Controller{
+		kubeClient: clientset,
+		index:      make(map[string][]ClusterEndpoint),
+		stopCh:     make(chan struct{}),
+	}
+	c.informerFactory = informers.NewSharedInformerFactory(clientset, 0)
+
+	informer := c.informerFactory.Discovery().V1().EndpointSlices().Informer()
+	c.informerFactory.Start(c.stopCh)
+	if !cache.WaitForCacheSync(c.stopCh, informer.HasSynced) {
+		t.Fatal("timed out waiting for informer cache to sync")
+	}
+
+	return c, c.stopCh
+}
+
+// TestController_RebuildIndex_Lookup verifies that rebuildIndex turns the
+// EndpointSlices backing a service into the ClusterEndpoints Lookup reports.
+func TestController_RebuildIndex_Lookup(t *testing.T) {
+	slice := endpointSlice("frontend-abc", "web", "frontend", "eu1", "10.0.0.1", "10.0.0.2")
+	c, stopCh := newTestController(t, slice)
+	defer close(stopCh)
+
+	c.rebuildIndex("web", "frontend")
+
+	eps, ok := c.Lookup("web", "frontend")
+	if !ok {
+		t.Fatal("expected a hit for web/frontend")
+	}
+	if len(eps) != 2 {
+		t.Fatalf("expected 2 endpoints, got %d", len(eps))
+	}
+	for _, ep := range eps {
+		if ep.ClusterID != "eu1" {
+			t.Errorf("expected ClusterID eu1, got %q", ep.ClusterID)
+		}
+		if len(ep.Ports) != 1 || ep.Ports[0].Port != 80 {
+			t.Errorf("expected a single port 80, got %+v", ep.Ports)
+		}
+	}
+
+	if _, ok := c.Lookup("web", "other-service"); ok {
+		t.Error("expected a miss for a service with no EndpointSlices")
+	}
+}
+
+// TestController_RebuildIndex_RemovesEmptyEntry verifies that rebuilding an
+// index entry for a service with no surviving EndpointSlices clears it
+// rather than leaving a stale empty slice behind.
+func TestController_RebuildIndex_RemovesEmptyEntry(t *testing.T) {
+	c, stopCh := newTestController(t)
+	defer close(stopCh)
+
+	c.mu.Lock()
+	c.index[indexKey("web", "frontend")] = []ClusterEndpoint{{ClusterID: "eu1"}}
+	c.mu.Unlock()
+
+	c.rebuildIndex("web", "frontend")
+
+	if _, ok := c.Lookup("web", "frontend"); ok {
+		t.Error("expected the stale entry to be removed once no EndpointSlices back it")
+	}
+}
+
+// TestController_Services lists the namespace/service pairs currently
+// indexed.
+func TestController_Services(t *testing.T) {
+	slice := endpointSlice("frontend-abc", "web", "frontend", "eu1", "10.0.0.1")
+	c, stopCh := newTestController(t, slice)
+	defer close(stopCh)
+
+	c.rebuildIndex("web", "frontend")
+
+	keys := c.Services()
+	if len(keys) != 1 || keys[0].Namespace != "web" || keys[0].Service != "frontend" {
+		t.Errorf("expected a single web/frontend entry, got %+v", keys)
+	}
+}
+
+// TestController_OnEndpointSliceChanged verifies that the informer callback
+// rebuilds the index entry keyed by the changed slice's service-name label.
+func TestController_OnEndpointSliceChanged(t *testing.T) {
+	slice := endpointSlice("frontend-abc", "web", "frontend", "eu1", "10.0.0.1")
+	c, stopCh := newTestController(t, slice)
+	defer close(stopCh)
+
+	// Give the informer's own add event a moment to land before driving the
+	// handler directly; rebuildIndex reads from the informer's lister, which
+	// only reflects objects once the watch event has been processed.
+	time.Sleep(50 * time.Millisecond)
+
+	c.onEndpointSliceChanged(slice)
+
+	if _, ok := c.Lookup("web", "frontend"); !ok {
+		t.Error("expected onEndpointSliceChanged to populate the index")
+	}
+}
+
+// TestSplitIndexKey verifies indexKey/splitIndexKey round-trip.
+func TestSplitIndexKey(t *testing.T) {
+	namespace, service, ok := splitIndexKey(indexKey("web", "frontend"))
+	if !ok || namespace != "web" || service != "frontend" {
+		t.Errorf("expected web/frontend, got %q/%q ok=%v", namespace, service, ok)
+	}
+
+	if _, _, ok := splitIndexKey("no-slash"); ok {
+		t.Error("expected ok=false for a key with no slash")
+	}
+}
@@ -1,12 +1,16 @@
 package k8s_cross
 
 import (
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/coredns/coredns/plugin"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/wold9168/k8s_cross/headscale"
 )
 
 // requestCount 导出一个 prometheus 指标，用于统计 k8s_cross 插件处理的请求数量。
@@ -18,4 +22,116 @@ var requestCount = promauto.NewCounterVec(prometheus.CounterOpts{
 	Help:      "Counter of DNS requests translated by k8s_cross.",
 }, []string{"server"}) // 按服务器标签区分不同实例的指标
 
+// once guards registerMetrics below, so building more than one K8sCross in
+// the same process (multiple Corefile server blocks, or multiple test
+// cases) only registers requestsTotal and friends a single time.
 var once sync.Once
+
+// requestsTotal, headscaleRequestDuration, headscaleErrorsTotal,
+// cacheHitsTotal/cacheMissesTotal and nodesIndexed are created lazily by
+// registerMetrics rather than at package-var init time, since a second
+// promauto registration of the same metric name panics and registerMetrics
+// may run more than once per process (see once above).
+var (
+	requestsTotal            *prometheus.CounterVec
+	headscaleRequestDuration *prometheus.HistogramVec
+	headscaleErrorsTotal     *prometheus.CounterVec
+	cacheHitsTotal           prometheus.Counter
+	cacheMissesTotal         prometheus.Counter
+	nodesIndexed             *prometheus.GaugeVec
+)
+
+// registerMetrics creates and registers requestsTotal and friends exactly
+// once per process. ServeDNS calls it on every request so the metrics exist
+// regardless of whether the caller went through setup.go (a real server) or
+// built a K8sCross directly (tests); once.Do makes repeated calls, including
+// from multiple server blocks or test cases in one process, harmless instead
+// of panicking on duplicate Prometheus registration.
+func registerMetrics() {
+	once.Do(func() {
+		requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: plugin.Namespace,
+			Subsystem: "k8s_cross",
+			Name:      "requests_total",
+			Help:      "Counter of k8s_cross DNS requests by zone, query type and response code.",
+		}, []string{"zone", "type", "rcode"})
+
+		headscaleRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: plugin.Namespace,
+			Subsystem: "k8s_cross",
+			Name:      "headscale_request_duration_seconds",
+			Help:      "Latency of k8s_cross's calls into the Headscale client, by operation.",
+		}, []string{"operation"})
+
+		headscaleErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: plugin.Namespace,
+			Subsystem: "k8s_cross",
+			Name:      "headscale_errors_total",
+			Help:      "Counter of failed k8s_cross calls into the Headscale client, by operation.",
+		}, []string{"operation"})
+
+		cacheHitsTotal = promauto.NewCounter(prometheus.CounterOpts{
+			Namespace: plugin.Namespace,
+			Subsystem: "k8s_cross",
+			Name:      "cache_hits_total",
+			Help:      "Counter of service lookups answered from the Headscale watcher's in-memory index.",
+		})
+
+		cacheMissesTotal = promauto.NewCounter(prometheus.CounterOpts{
+			Namespace: plugin.Namespace,
+			Subsystem: "k8s_cross",
+			Name:      "cache_misses_total",
+			Help:      "Counter of service lookups that missed the Headscale watcher's in-memory index.",
+		})
+
+		nodesIndexed = promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: plugin.Namespace,
+			Subsystem: "k8s_cross",
+			Name:      "nodes_indexed",
+			Help:      "Number of Headscale nodes currently held in the watcher's in-memory index, by cluster.",
+		}, []string{"cluster"})
+	})
+}
+
+// instrumentHeadscale runs fn, recording its latency and whether it failed
+// under headscaleRequestDuration/headscaleErrorsTotal labeled by operation.
+// Call sites that reach into HeadscaleClient directly (findServiceNodesByTag,
+// findServiceNodesByNamePrefix, translateToTailnet) wrap the call with this
+// instead of timing themselves.
+func instrumentHeadscale(operation string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	headscaleRequestDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		headscaleErrorsTotal.WithLabelValues(operation).Inc()
+	}
+	return err
+}
+
+// updateNodesIndexed recomputes nodesIndexed from a freshly synced node
+// snapshot. setup.go registers it as the Watcher's update hook via
+// SetOnUpdate when the `watch` directive is configured.
+func updateNodesIndexed(nodes []headscale.Node) {
+	counts := make(map[string]int)
+	for _, node := range nodes {
+		counts[clusterFromTags(node)]++
+	}
+
+	nodesIndexed.Reset()
+	for cluster, count := range counts {
+		nodesIndexed.WithLabelValues(cluster).Set(float64(count))
+	}
+}
+
+// clusterFromTags returns the cluster name encoded in a node's
+// tag:cluster-<cluster> tag (the same vocabulary filterNodesByCluster reads),
+// or "" if the node carries none.
+func clusterFromTags(node headscale.Node) string {
+	const prefix = "tag:cluster-"
+	for _, tag := range append(append([]string{}, node.ForcedTags...), node.ValidTags...) {
+		if strings.HasPrefix(tag, prefix) {
+			return strings.TrimPrefix(tag, prefix)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,116 @@
+package k8s_cross
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/wold9168/k8s_cross/headscale"
+	"github.com/wold9168/k8s_cross/headscale/watch"
+)
+
+// TestRegisterMetrics_Idempotent verifies that calling registerMetrics more
+// than once (as happens across multiple ServeDNS calls, or multiple Corefile
+// server blocks in one process) doesn't panic on duplicate Prometheus
+// registration.
+func TestRegisterMetrics_Idempotent(t *testing.T) {
+	registerMetrics()
+	registerMetrics()
+
+	if requestsTotal == nil {
+		t.Fatal("expected requestsTotal to be initialized after registerMetrics")
+	}
+}
+
+// TestServeDNS_RequestsTotal verifies that a clusterset query is counted
+// under requests_total with the matched zone, query type and response code.
+func TestServeDNS_RequestsTotal(t *testing.T) {
+	registerMetrics()
+	requestsTotal.Reset()
+
+	mockClient := &MockHeadscaleClient{
+		Nodes: []headscale.Node{
+			{ID: "1", Name: "my-service-1", IPAddresses: []string{"10.0.0.1"}},
+		},
+	}
+	x := K8sCross{
+		Next:            test.ErrorHandler(),
+		HeadscaleClient: mockClient,
+		Zones:           []string{"clusterset.local"},
+		TTL:             300,
+		ClusterSet:      "test-clusterset",
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion("my-service.my-namespace.svc.clusterset.local.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+	if _, err := x.ServeDNS(context.Background(), rec, r); err != nil {
+		t.Fatalf("ServeDNS: %v", err)
+	}
+
+	if got := testutil.CollectAndCount(requestsTotal); got == 0 {
+		t.Error("expected requests_total to have at least one observation")
+	}
+}
+
+// TestFindServiceNodesByTag_CacheMetrics verifies that Watcher-backed lookups
+// are reflected in cache_hits_total/cache_misses_total.
+func TestFindServiceNodesByTag_CacheMetrics(t *testing.T) {
+	registerMetrics()
+
+	mockClient := &MockHeadscaleClient{Nodes: []headscale.Node{
+		{ID: "1", Name: "node-1", ForcedTags: []string{"tag:mcs-test-clusterset-my-namespace-my-service"}},
+	}}
+	w := watch.NewWatcher(mockClient, "http://headscale.test", time.Minute)
+	if err := w.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer w.Stop()
+
+	x := K8sCross{HeadscaleClient: mockClient, ClusterSet: "test-clusterset", Watcher: w}
+
+	hitsBefore := testutil.ToFloat64(cacheHitsTotal)
+	if _, err := x.findServiceNodesByTag(context.Background(), "my-service", "my-namespace"); err != nil {
+		t.Fatalf("findServiceNodesByTag: %v", err)
+	}
+	if got := testutil.ToFloat64(cacheHitsTotal); got != hitsBefore+1 {
+		t.Errorf("expected cache_hits_total to increase by 1, got %v -> %v", hitsBefore, got)
+	}
+
+	missesBefore := testutil.ToFloat64(cacheMissesTotal)
+	if _, err := x.findServiceNodesByTag(context.Background(), "no-such-service", "my-namespace"); err != nil {
+		t.Fatalf("findServiceNodesByTag: %v", err)
+	}
+	if got := testutil.ToFloat64(cacheMissesTotal); got != missesBefore+1 {
+		t.Errorf("expected cache_misses_total to increase by 1, got %v -> %v", missesBefore, got)
+	}
+}
+
+// TestUpdateNodesIndexed verifies that pushing a watcher snapshot updates
+// nodes_indexed per the tag:cluster-<cluster> tag on each node.
+func TestUpdateNodesIndexed(t *testing.T) {
+	registerMetrics()
+
+	mockClient := &MockHeadscaleClient{}
+	w := watch.NewWatcher(mockClient, "http://headscale.test", time.Minute)
+	w.SetOnUpdate(updateNodesIndexed)
+
+	w.Push([]headscale.Node{
+		{ID: "1", Name: "eu1-node", ForcedTags: []string{"tag:cluster-eu1"}},
+		{ID: "2", Name: "us1-node", ForcedTags: []string{"tag:cluster-us1"}},
+		{ID: "3", Name: "other-eu1-node", ForcedTags: []string{"tag:cluster-eu1"}},
+	})
+
+	if got := testutil.ToFloat64(nodesIndexed.WithLabelValues("eu1")); got != 2 {
+		t.Errorf("expected 2 nodes indexed for cluster eu1, got %v", got)
+	}
+	if got := testutil.ToFloat64(nodesIndexed.WithLabelValues("us1")); got != 1 {
+		t.Errorf("expected 1 node indexed for cluster us1, got %v", got)
+	}
+}
@@ -1,6 +1,67 @@
 package k8s_cross
 
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// readyCacheTTL 限制 Ready 实际调用 Headscale 健康检查接口的频率；在此时间
+// 窗口内重复调用只返回上一次的结果，避免 CoreDNS 自身的就绪轮询频繁打到
+// Headscale。
+const readyCacheTTL = 5 * time.Second
+
+// readyCache 保存 Ready 上一次健康检查的结果和时间，由 K8sCross.ready 持有。
+type readyCache struct {
+	mu      sync.Mutex
+	healthy bool
+	checked time.Time
+}
+
 // Ready 实现了 ready.Readiness 接口，用于报告插件是否已准备好处理查询。
 // 当此方法返回 true 时，CoreDNS 认为插件已就绪，此后不再检查。
-// 对于 k8s_cross 插件，由于不需要特殊初始化，始终返回 true。
-func (e K8sCross) Ready() bool { return true }
+// k8s_cross 要求 Headscale 的健康检查通过（数据库可达），并且——一旦配置了
+// Watcher——其初始同步也已成功完成，才报告就绪；否则过早到来的查询会悄悄
+// 拿到空结果。
+func (e K8sCross) Ready() bool {
+	if e.Watcher != nil && e.Watcher.LastSync().IsZero() {
+		return false
+	}
+	return e.headscaleHealthy(context.Background())
+}
+
+// headscaleHealthy 返回最近一次 Headscale 健康检查的结果，必要时重新检查；
+// e.ready 为 nil（例如测试中直接构造的 K8sCross）时则不缓存，每次都重新检查。
+func (e K8sCross) headscaleHealthy(ctx context.Context) bool {
+	if e.HeadscaleClient == nil {
+		return false
+	}
+	if e.ready == nil {
+		return e.checkHeadscaleHealth(ctx)
+	}
+
+	e.ready.mu.Lock()
+	defer e.ready.mu.Unlock()
+	if time.Since(e.ready.checked) < readyCacheTTL {
+		return e.ready.healthy
+	}
+	e.ready.healthy = e.checkHeadscaleHealth(ctx)
+	e.ready.checked = time.Now()
+	return e.ready.healthy
+}
+
+// checkHeadscaleHealth calls HeadscaleClient.Health directly, with no
+// caching, and reports whether Headscale is reachable with a working
+// database.
+func (e K8sCross) checkHeadscaleHealth(ctx context.Context) bool {
+	var healthy bool
+	instrumentHeadscale("health", func() error {
+		health, err := e.HeadscaleClient.Health(ctx)
+		if err != nil {
+			return err
+		}
+		healthy = health.DatabaseConnectivity
+		return nil
+	})
+	return healthy
+}
@@ -0,0 +1,94 @@
+package k8s_cross
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/wold9168/k8s_cross/headscale"
+	"github.com/wold9168/k8s_cross/headscale/watch"
+)
+
+var errNotReachable = errors.New("headscale unreachable")
+
+// TestReady_Healthy verifies that a healthy Headscale client with no
+// configured Watcher reports ready.
+func TestReady_Healthy(t *testing.T) {
+	e := K8sCross{HeadscaleClient: &MockHeadscaleClient{}}
+	if !e.Ready() {
+		t.Error("expected Ready() to be true for a healthy client")
+	}
+}
+
+// TestReady_Unhealthy verifies that a client reporting broken database
+// connectivity is reflected as not ready.
+func TestReady_Unhealthy(t *testing.T) {
+	e := K8sCross{
+		HeadscaleClient: &MockHeadscaleClient{
+			HealthResponse: &headscale.HealthResponse{DatabaseConnectivity: false},
+		},
+	}
+	if e.Ready() {
+		t.Error("expected Ready() to be false when DatabaseConnectivity is false")
+	}
+}
+
+// TestReady_HealthCheckError verifies that a Health call failing outright
+// (Headscale unreachable) is also reported as not ready.
+func TestReady_HealthCheckError(t *testing.T) {
+	e := K8sCross{
+		HeadscaleClient: &MockHeadscaleClient{HealthErr: errNotReachable},
+	}
+	if e.Ready() {
+		t.Error("expected Ready() to be false when Health returns an error")
+	}
+}
+
+// TestReady_WatcherNotYetSynced verifies that a configured Watcher which
+// hasn't completed its first sync holds the plugin not-ready even though
+// Headscale itself is healthy, so queries don't race the initial sync.
+func TestReady_WatcherNotYetSynced(t *testing.T) {
+	client := &MockHeadscaleClient{}
+	e := K8sCross{
+		HeadscaleClient: client,
+		Watcher:         watch.NewWatcher(client, "http://headscale.test", time.Minute),
+	}
+	if e.Ready() {
+		t.Error("expected Ready() to be false before the watcher's first sync")
+	}
+}
+
+// TestReady_WatcherSynced verifies that once the Watcher has synced and
+// Headscale is healthy, the plugin reports ready.
+func TestReady_WatcherSynced(t *testing.T) {
+	client := &MockHeadscaleClient{}
+	w := watch.NewWatcher(client, "http://headscale.test", time.Minute)
+	w.Push(nil)
+
+	e := K8sCross{HeadscaleClient: client, Watcher: w}
+	if !e.Ready() {
+		t.Error("expected Ready() to be true once the watcher has synced and Headscale is healthy")
+	}
+}
+
+// TestReady_CachesHealthCheck verifies that a health flip within
+// readyCacheTTL isn't reflected until the cache expires, so CoreDNS's own
+// readiness polling doesn't hit Headscale on every check.
+func TestReady_CachesHealthCheck(t *testing.T) {
+	client := &MockHeadscaleClient{}
+	e := K8sCross{HeadscaleClient: client, ready: &readyCache{}}
+
+	if !e.Ready() {
+		t.Fatal("expected initial Ready() to be true")
+	}
+
+	client.HealthResponse = &headscale.HealthResponse{DatabaseConnectivity: false}
+	if !e.Ready() {
+		t.Error("expected Ready() to still report the cached healthy result within readyCacheTTL")
+	}
+
+	e.ready.checked = time.Now().Add(-readyCacheTTL - time.Second)
+	if e.Ready() {
+		t.Error("expected Ready() to pick up the health flip once the cache expired")
+	}
+}
@@ -0,0 +1,248 @@
+package k8s_cross
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wold9168/k8s_cross/headscale"
+	"github.com/wold9168/k8s_cross/mcs"
+)
+
+// defaultReconcileInterval is how often startTagReconciler re-checks node
+// tags and rebuilds the reverse index; setup.go always starts the reconciler
+// with this interval, and no Corefile directive changes it.
+const defaultReconcileInterval = 30 * time.Second
+
+// joinKeyTTL bounds how long a provisioned pre-auth key remains usable. It's
+// comfortably longer than defaultReconcileInterval so a key survives until
+// the workload it's meant for actually joins, while still expiring rather
+// than accumulating indefinitely for services that never do.
+const joinKeyTTL = 1 * time.Hour
+
+// joinKeyStore holds the most recently provisioned Headscale pre-auth key
+// for each service reconcileTags found with no backing tailnet node yet,
+// keyed the same way as mcs's index (namespace/service). It follows the
+// same pointer-field, mutex-guarded convention as reverseIndex.
+type joinKeyStore struct {
+	mu   sync.RWMutex
+	keys map[string]*headscale.PreAuthKey
+}
+
+func newJoinKeyStore() *joinKeyStore {
+	return &joinKeyStore{keys: make(map[string]*headscale.PreAuthKey)}
+}
+
+// get returns the pending join key for namespace/service, if one has been
+// provisioned and not yet superseded.
+func (s *joinKeyStore) get(namespace, service string) (*headscale.PreAuthKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.keys[namespace+"/"+service]
+	return key, ok
+}
+
+// set records the join key just provisioned for namespace/service.
+func (s *joinKeyStore) set(namespace, service string, key *headscale.PreAuthKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[namespace+"/"+service] = key
+}
+
+// clear drops namespace/service's pending join key once its node has
+// registered and been tagged, so a later service recreation provisions a
+// fresh one instead of reporting a stale, possibly-expired key. A nil
+// receiver (no MCS controller configured) is a no-op.
+func (s *joinKeyStore) clear(namespace, service string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, namespace+"/"+service)
+}
+
+// JoinKey returns the Headscale pre-auth key reconcileTags most recently
+// provisioned for namespace/service, if that service still has no backing
+// tailnet node. Operators (or a provisioning job) use this to pick up a key
+// for a workload that hasn't registered with Headscale yet; it reports
+// ok=false once the node joins and picks up its tag, or if no MCS controller
+// is configured.
+func (e *K8sCross) JoinKey(namespace, service string) (*headscale.PreAuthKey, bool) {
+	if e.joinKeys == nil {
+		return nil, false
+	}
+	return e.joinKeys.get(namespace, service)
+}
+
+// startTagReconciler runs reconcileTags and rebuildReverseIndex on a timer
+// until the returned stop function is called. Both are only useful once an
+// MCS controller is configured, since they walk the services it knows about.
+func (e *K8sCross) startTagReconciler(interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				e.reconcileTags(context.Background())
+				e.rebuildReverseIndex(context.Background())
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// rebuildReverseIndex recomputes the IP->FQDN reverse index from the same
+// MCS-backed endpoint set handleClustersetQuery uses for forward answers,
+// so PTR answers stay consistent with A/AAAA ones.
+func (e *K8sCross) rebuildReverseIndex(ctx context.Context) {
+	if e.MCS == nil || e.reverseIdx == nil {
+		return
+	}
+
+	controller, ok := e.MCS.(*mcs.Controller)
+	if !ok {
+		return
+	}
+
+	entries := make(map[string]string)
+	for _, svc := range controller.Services() {
+		endpoints, ok := e.MCS.Lookup(svc.Namespace, svc.Service)
+		if !ok {
+			continue
+		}
+
+		nodes, err := e.resolveEndpoints(ctx, endpoints)
+		if err != nil {
+			log.Warningf("reverse index: resolving endpoints for %s.%s: %v", svc.Service, svc.Namespace, err)
+			continue
+		}
+
+		fqdn := fmt.Sprintf("%s.%s.svc.clusterset.local.", svc.Service, svc.Namespace)
+		for _, node := range nodes {
+			for _, ip := range node.IPAddresses {
+				entries[ip] = fqdn
+			}
+		}
+	}
+
+	e.reverseIdx.replace(entries)
+}
+
+// reconcileTags compares each known service's desired tag (see serviceTag)
+// against the actual tags of the Headscale nodes backing it in this
+// cluster, and calls SetNodeTags to add any that are missing. It never
+// removes tags, since a node may legitimately back more than one service.
+func (e *K8sCross) reconcileTags(ctx context.Context) {
+	if e.MCS == nil || e.HeadscaleClient == nil {
+		return
+	}
+
+	controller, ok := e.MCS.(*mcs.Controller)
+	if !ok {
+		return
+	}
+
+	for _, svc := range controller.Services() {
+		endpoints, ok := e.MCS.Lookup(svc.Namespace, svc.Service)
+		if !ok {
+			continue
+		}
+
+		desiredTag := e.serviceTag(svc.Service, svc.Namespace)
+		for _, ep := range endpoints {
+			if ep.ClusterID != "" && ep.ClusterID != e.ClusterName {
+				// This endpoint belongs to a remote cluster; its node (if any)
+				// is that cluster's Headscale node, not ours to tag.
+				continue
+			}
+			if ep.Hostname == "" {
+				continue
+			}
+
+			node, err := e.findHeadscaleNodeByHostname(ctx, ep.Hostname)
+			if err != nil {
+				log.Warningf("reconcile: looking up node %q: %v", ep.Hostname, err)
+				continue
+			}
+			if node == nil {
+				// The workload exists per Kubernetes but hasn't registered
+				// with Headscale yet; provision it a pre-auth key tagged
+				// with desiredTag so it carries the right service identity
+				// the moment it joins, instead of waiting for a later
+				// reconcile pass to notice and tag it.
+				e.provisionJoinKey(ctx, svc.Service, svc.Namespace, desiredTag)
+				continue
+			}
+			if node.HasTag(desiredTag) {
+				e.joinKeys.clear(svc.Namespace, svc.Service)
+				continue
+			}
+
+			newTags := append(append([]string{}, node.ForcedTags...), desiredTag)
+			err = instrumentHeadscale("set_node_tags", func() error {
+				return e.HeadscaleClient.SetNodeTags(ctx, node.ID, newTags)
+			})
+			if err != nil {
+				log.Errorf("reconcile: setting tags on node %s: %v", node.ID, err)
+			}
+		}
+	}
+}
+
+// provisionJoinKey creates a Headscale pre-auth key tagged with tag for
+// service/namespace, so a workload that later registers under it already
+// carries the right service identity, and records it in e.joinKeys for a
+// consumer to pick up. It's a no-op if joinKeys isn't configured (no MCS
+// controller) or a key is already pending for this service.
+func (e *K8sCross) provisionJoinKey(ctx context.Context, service, namespace, tag string) {
+	if e.joinKeys == nil {
+		return
+	}
+	if _, ok := e.joinKeys.get(namespace, service); ok {
+		return
+	}
+
+	var key *headscale.PreAuthKey
+	err := instrumentHeadscale("create_preauth_key", func() error {
+		var createErr error
+		key, createErr = e.HeadscaleClient.CreatePreAuthKey(ctx, namespace, []string{tag}, time.Now().Add(joinKeyTTL))
+		return createErr
+	})
+	if err != nil {
+		log.Warningf("reconcile: provisioning join key for %s.%s: %v", service, namespace, err)
+		return
+	}
+
+	e.joinKeys.set(namespace, service, key)
+	log.Infof("reconcile: provisioned a Headscale join key for %s.%s (tag %s)", service, namespace, tag)
+}
+
+// findHeadscaleNodeByHostname looks up the Headscale node registered under
+// hostname, or returns (nil, nil) if none matches.
+func (e *K8sCross) findHeadscaleNodeByHostname(ctx context.Context, hostname string) (*Node, error) {
+	var nodes []Node
+	err := instrumentHeadscale("list_nodes", func() error {
+		var listErr error
+		nodes, listErr = e.HeadscaleClient.ListNodes(ctx, "")
+		return listErr
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range nodes {
+		if strings.EqualFold(nodes[i].Name, hostname) {
+			return &nodes[i], nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,80 @@
+package k8s_cross
+
+import (
+	"context"
+	"testing"
+)
+
+// TestJoinKeyStore_SetGetClear exercises the basic get/set/clear lifecycle a
+// pending join key goes through as a node registers and picks up its tag.
+func TestJoinKeyStore_SetGetClear(t *testing.T) {
+	s := newJoinKeyStore()
+
+	if _, ok := s.get("web", "frontend"); ok {
+		t.Fatal("expected no key before set")
+	}
+
+	s.set("web", "frontend", nil)
+	if _, ok := s.get("web", "frontend"); !ok {
+		t.Error("expected a key after set")
+	}
+
+	s.clear("web", "frontend")
+	if _, ok := s.get("web", "frontend"); ok {
+		t.Error("expected no key after clear")
+	}
+}
+
+// TestProvisionJoinKey_CreatesAndCaches verifies that provisionJoinKey calls
+// CreatePreAuthKey and makes the result available via JoinKey.
+func TestProvisionJoinKey_CreatesAndCaches(t *testing.T) {
+	registerMetrics()
+	mockClient := &MockHeadscaleClient{}
+	e := &K8sCross{
+		HeadscaleClient: mockClient,
+		joinKeys:        newJoinKeyStore(),
+	}
+
+	e.provisionJoinKey(context.Background(), "frontend", "web", "tag:mcs-test-web-frontend")
+
+	key, ok := e.JoinKey("web", "frontend")
+	if !ok {
+		t.Fatal("expected a pending join key after provisionJoinKey")
+	}
+	if len(key.Tags) != 1 || key.Tags[0] != "tag:mcs-test-web-frontend" {
+		t.Errorf("expected the key to carry the desired tag, got %v", key.Tags)
+	}
+}
+
+// TestProvisionJoinKey_AlreadyPending verifies that provisionJoinKey doesn't
+// re-provision a key while one is already pending for the same service.
+func TestProvisionJoinKey_AlreadyPending(t *testing.T) {
+	registerMetrics()
+	mockClient := &MockHeadscaleClient{}
+	e := &K8sCross{
+		HeadscaleClient: mockClient,
+		joinKeys:        newJoinKeyStore(),
+	}
+
+	e.provisionJoinKey(context.Background(), "frontend", "web", "tag:a")
+	first, _ := e.JoinKey("web", "frontend")
+
+	e.provisionJoinKey(context.Background(), "frontend", "web", "tag:b")
+	second, _ := e.JoinKey("web", "frontend")
+
+	if first != second {
+		t.Error("expected provisionJoinKey to leave the already-pending key untouched")
+	}
+}
+
+// TestProvisionJoinKey_NilStore verifies that provisionJoinKey is a no-op
+// (not a panic) when no MCS controller is configured.
+func TestProvisionJoinKey_NilStore(t *testing.T) {
+	registerMetrics()
+	e := &K8sCross{HeadscaleClient: &MockHeadscaleClient{}}
+	e.provisionJoinKey(context.Background(), "frontend", "web", "tag:a")
+
+	if _, ok := e.JoinKey("web", "frontend"); ok {
+		t.Error("expected no key to be recorded without a joinKeys store")
+	}
+}
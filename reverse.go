@@ -0,0 +1,32 @@
+package k8s_cross
+
+import "sync"
+
+// reverseIndex is a thread-safe IP -> FQDN map used to answer PTR queries
+// for addresses the plugin has already synthesized A/AAAA answers for. It's
+// rebuilt wholesale on each reconciler tick (see rebuildReverseIndex) rather
+// than updated incrementally, since a full rebuild is cheap at this scale
+// and avoids having to track deletions as services come and go.
+type reverseIndex struct {
+	mu      sync.RWMutex
+	entries map[string]string
+}
+
+func newReverseIndex() *reverseIndex {
+	return &reverseIndex{entries: make(map[string]string)}
+}
+
+// lookup returns the FQDN registered for ip, if any.
+func (r *reverseIndex) lookup(ip string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	fqdn, ok := r.entries[ip]
+	return fqdn, ok
+}
+
+// replace atomically swaps in a freshly rebuilt set of entries.
+func (r *reverseIndex) replace(entries map[string]string) {
+	r.mu.Lock()
+	r.entries = entries
+	r.mu.Unlock()
+}
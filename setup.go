@@ -1,14 +1,65 @@
 package k8s_cross
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
 	"github.com/wold9168/k8s_cross/headscale"
+	"github.com/wold9168/k8s_cross/headscale/watch"
+	"github.com/wold9168/k8s_cross/mcs"
 )
 
+// serviceAccountTokenPath is where Kubernetes mounts the pod's service
+// account token, alongside the CA bundle that rest.InClusterConfig reads.
+const serviceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// namespaceFromServiceAccountToken decodes the unverified JWT payload of the
+// mounted service account token and returns its
+// "kubernetes.io/serviceaccount/namespace" claim. The plugin only uses this
+// to pick a default namespace, never to authenticate, so signature
+// verification is left to the API server the token is actually presented to.
+func namespaceFromServiceAccountToken(tokenPath string) (string, error) {
+	raw, err := os.ReadFile(tokenPath)
+	if err != nil {
+		return "", fmt.Errorf("reading service account token: %w", err)
+	}
+
+	parts := strings.Split(strings.TrimSpace(string(raw)), ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("service account token is not a well-formed JWT")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("decoding JWT payload: %w", err)
+	}
+
+	var claims struct {
+		Namespace string `json:"kubernetes.io/serviceaccount/namespace"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("parsing JWT claims: %w", err)
+	}
+	if claims.Namespace == "" {
+		return "", fmt.Errorf("JWT has no kubernetes.io/serviceaccount/namespace claim")
+	}
+
+	return claims.Namespace, nil
+}
+
 // init registers this plugin with CoreDNS.
 func init() {
 	caddy.RegisterPlugin("k8s_cross", caddy.Plugin{
@@ -26,6 +77,52 @@ func setup(c *caddy.Controller) error {
 		return plugin.Error("k8s_cross", err)
 	}
 
+	// If the Corefile asked for the background node watcher, start it now
+	// and make sure it's stopped when CoreDNS shuts down. Its initial sync
+	// runs synchronously so setup fails fast if Headscale is unreachable,
+	// same as the existing mcs controller start below; ready_timeout bounds
+	// how long that initial sync may take.
+	if k8sCross.Watcher != nil {
+		k8sCross.Watcher.SetOnUpdate(updateNodesIndexed)
+
+		startCtx := context.Background()
+		if k8sCross.ReadyTimeout > 0 {
+			var cancel context.CancelFunc
+			startCtx, cancel = context.WithTimeout(startCtx, k8sCross.ReadyTimeout)
+			defer cancel()
+		}
+
+		if err := k8sCross.Watcher.Start(startCtx); err != nil {
+			return plugin.Error("k8s_cross", fmt.Errorf("starting headscale watcher: %w", err))
+		}
+		c.OnShutdown(func() error {
+			k8sCross.Watcher.Stop()
+			return nil
+		})
+	}
+
+	// If the Corefile asked for Kubernetes-backed service discovery, start the
+	// mcs controller now and make sure it's stopped when CoreDNS shuts down.
+	if k8sCross.mcsController != nil {
+		if err := k8sCross.mcsController.Start(context.Background()); err != nil {
+			return plugin.Error("k8s_cross", fmt.Errorf("starting mcs controller: %w", err))
+		}
+		c.OnShutdown(func() error {
+			k8sCross.mcsController.Stop()
+			return nil
+		})
+		k8sCross.MCS = k8sCross.mcsController
+		k8sCross.joinKeys = newJoinKeyStore()
+
+		// Keep Headscale node tags aligned with the services this cluster
+		// exports so findServiceNodesByTag can trust them.
+		stopReconciler := k8sCross.startTagReconciler(defaultReconcileInterval)
+		c.OnShutdown(func() error {
+			stopReconciler()
+			return nil
+		})
+	}
+
 	// Add the plugin to the DNS server middleware chain
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		k8sCross.Next = next
@@ -35,6 +132,18 @@ func setup(c *caddy.Controller) error {
 	return nil
 }
 
+// headscaleClientFor returns k8sCross's Headscale client as a *headscale.Client,
+// so directive handlers can tune its resilience settings. It errors if
+// headscale_url hasn't been set yet, or set it to something other than the
+// built-in client.
+func headscaleClientFor(k8sCross *K8sCross, directive string) (*headscale.Client, error) {
+	client, ok := k8sCross.HeadscaleClient.(*headscale.Client)
+	if !ok {
+		return nil, fmt.Errorf("%s requires headscale_url to be set first", directive)
+	}
+	return client, nil
+}
+
 // parseConfig parses the configuration for the k8s_cross plugin from the CoreDNS config.
 func parseConfig(c *caddy.Controller) (*K8sCross, error) {
 	var k8sCross *K8sCross
@@ -53,6 +162,9 @@ func parseConfig(c *caddy.Controller) (*K8sCross, error) {
 			TTL:         300, // Default TTL of 5 minutes
 			ClusterName: "default-cluster",
 			ClusterSet:  "default-clusterset",
+			reverseIdx:  newReverseIndex(),
+			ready:       &readyCache{},
+			tagTmpl:     defaultTagTmpl,
 		}
 
 		// Parse configuration options
@@ -68,12 +180,132 @@ func parseConfig(c *caddy.Controller) (*K8sCross, error) {
 				apiKey := args[1]
 
 				// Create Headscale client
-				client := headscale.NewClient(url, apiKey)
+				client, err := headscale.NewClient(url, apiKey)
+				if err != nil {
+					return nil, fmt.Errorf("creating Headscale client: %w", err)
+				}
 				k8sCross.HeadscaleClient = client
 
 				// Test the connection
 				// Note: In a production implementation, you might want to defer this check
 				// until the plugin is actually used to avoid startup delays
+			case "headscale_retry":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, fmt.Errorf("headscale_retry requires exactly one argument")
+				}
+				client, err := headscaleClientFor(k8sCross, "headscale_retry")
+				if err != nil {
+					return nil, err
+				}
+				var retryMax int
+				if _, err := fmt.Sscanf(args[0], "%d", &retryMax); err != nil {
+					return nil, fmt.Errorf("invalid headscale_retry value: %s", args[0])
+				}
+				client.RetryMax = retryMax
+			case "headscale_cache":
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return nil, fmt.Errorf("headscale_cache requires a positive and a negative TTL, e.g. \"headscale_cache 5s 1s\"")
+				}
+				client, err := headscaleClientFor(k8sCross, "headscale_cache")
+				if err != nil {
+					return nil, err
+				}
+				positive, err := time.ParseDuration(args[0])
+				if err != nil {
+					return nil, fmt.Errorf("invalid headscale_cache positive TTL: %s", args[0])
+				}
+				negative, err := time.ParseDuration(args[1])
+				if err != nil {
+					return nil, fmt.Errorf("invalid headscale_cache negative TTL: %s", args[1])
+				}
+				client.SetCacheTTLs(positive, negative)
+			case "headscale_breaker":
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return nil, fmt.Errorf("headscale_breaker requires a failure threshold and a cooldown, e.g. \"headscale_breaker 5 30s\"")
+				}
+				client, err := headscaleClientFor(k8sCross, "headscale_breaker")
+				if err != nil {
+					return nil, err
+				}
+				var threshold int
+				if _, err := fmt.Sscanf(args[0], "%d", &threshold); err != nil {
+					return nil, fmt.Errorf("invalid headscale_breaker threshold: %s", args[0])
+				}
+				cooldown, err := time.ParseDuration(args[1])
+				if err != nil {
+					return nil, fmt.Errorf("invalid headscale_breaker cooldown: %s", args[1])
+				}
+				client.SetBreakerThreshold(threshold, cooldown)
+			case "watch":
+				// Enable the background node watcher in place of per-query
+				// ListNodesByTag calls. Takes an optional refresh interval
+				// (default 10s); the watch_cache_size/watch_negative_ttl
+				// directives tune the watcher's own tag index independently
+				// of headscale_cache,
+				// which only covers the HTTP client's response cache.
+				args := c.RemainingArgs()
+				if len(args) > 1 {
+					return nil, fmt.Errorf("watch takes at most one argument (the refresh interval)")
+				}
+				client, err := headscaleClientFor(k8sCross, "watch")
+				if err != nil {
+					return nil, err
+				}
+				interval := time.Duration(0)
+				if len(args) == 1 {
+					interval, err = time.ParseDuration(args[0])
+					if err != nil {
+						return nil, fmt.Errorf("invalid watch refresh interval: %s", args[0])
+					}
+				}
+				k8sCross.Watcher = watch.NewWatcher(client, client.BaseURL, interval)
+			case "watch_cache_size":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, fmt.Errorf("watch_cache_size requires exactly one argument")
+				}
+				if k8sCross.Watcher == nil {
+					return nil, fmt.Errorf("watch_cache_size requires watch to be set first")
+				}
+				var size int
+				if _, err := fmt.Sscanf(args[0], "%d", &size); err != nil {
+					return nil, fmt.Errorf("invalid watch_cache_size value: %s", args[0])
+				}
+				k8sCross.Watcher.SetCacheSize(size)
+			case "watch_negative_ttl":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, fmt.Errorf("watch_negative_ttl requires exactly one argument")
+				}
+				if k8sCross.Watcher == nil {
+					return nil, fmt.Errorf("watch_negative_ttl requires watch to be set first")
+				}
+				ttl, err := time.ParseDuration(args[0])
+				if err != nil {
+					return nil, fmt.Errorf("invalid watch_negative_ttl value: %s", args[0])
+				}
+				k8sCross.Watcher.SetNegativeTTL(ttl)
+			case "ready_timeout":
+				// Bounds how long the watcher's initial sync may run at
+				// startup (see setup below) before giving up and failing.
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, fmt.Errorf("ready_timeout requires exactly one argument")
+				}
+				timeout, err := time.ParseDuration(args[0])
+				if err != nil {
+					return nil, fmt.Errorf("invalid ready_timeout value: %s", args[0])
+				}
+				k8sCross.ReadyTimeout = timeout
+			case "fallthrough":
+				// Queries that match a configured zone but find no service
+				// nodes are passed to the next plugin instead of answered
+				// empty. With no arguments this applies to every zone the
+				// plugin handles; naming zones restricts it to just those.
+				k8sCross.Fallthrough = fallthroughConfig{enabled: true, zones: c.RemainingArgs()}
 			case "ttl":
 				// Parse custom TTL value
 				args := c.RemainingArgs()
@@ -100,6 +332,138 @@ func parseConfig(c *caddy.Controller) (*K8sCross, error) {
 					return nil, fmt.Errorf("clusterset requires exactly one argument")
 				}
 				k8sCross.ClusterSet = args[0]
+			case "incluster":
+				// Build an MCS controller from the in-cluster service account config:
+				// CA bundle, bearer token and KUBERNETES_SERVICE_HOST/PORT.
+				if args := c.RemainingArgs(); len(args) != 0 {
+					return nil, fmt.Errorf("incluster takes no arguments")
+				}
+				config, err := rest.InClusterConfig()
+				if err != nil {
+					return nil, fmt.Errorf("loading in-cluster config: %w", err)
+				}
+				controller, err := mcs.NewController(config)
+				if err != nil {
+					return nil, fmt.Errorf("building mcs controller: %w", err)
+				}
+				k8sCross.mcsController = controller
+
+				// Fall back to the service account's own namespace when the
+				// Corefile didn't set one explicitly.
+				if k8sCross.Namespace == "" {
+					ns, err := namespaceFromServiceAccountToken(serviceAccountTokenPath)
+					if err != nil {
+						return nil, fmt.Errorf("discovering namespace from service account token: %w", err)
+					}
+					k8sCross.Namespace = ns
+				}
+			case "reverse":
+				// PTR answers for these CIDRs only ever come from the
+				// MCS-backed reverse index (see isReverseQuery), so this is
+				// rejected below (once incluster/kubeconfig's presence is
+				// known) if no MCS controller was configured.
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, fmt.Errorf("reverse requires at least one CIDR")
+				}
+				for _, arg := range args {
+					_, ipNet, err := net.ParseCIDR(arg)
+					if err != nil {
+						return nil, fmt.Errorf("invalid reverse CIDR %q: %w", arg, err)
+					}
+					k8sCross.ReverseZones = append(k8sCross.ReverseZones, ipNet)
+				}
+			case "namespace":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, fmt.Errorf("namespace requires exactly one argument")
+				}
+				k8sCross.Namespace = args[0]
+			case "answer_family":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, fmt.Errorf("answer_family requires exactly one argument")
+				}
+				switch args[0] {
+				case answerFamilyDual, answerFamilyPreferV4, answerFamilyPreferV6, answerFamilyV4Only, answerFamilyV6Only:
+					k8sCross.AnswerFamily = args[0]
+				default:
+					return nil, fmt.Errorf("unknown answer_family %q, expected one of %q, %q, %q, %q, %q",
+						args[0], answerFamilyDual, answerFamilyPreferV4, answerFamilyPreferV6, answerFamilyV4Only, answerFamilyV6Only)
+				}
+			case "match_mode":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, fmt.Errorf("match_mode requires exactly one argument")
+				}
+				if args[0] != matchModeNamePrefix {
+					return nil, fmt.Errorf("unknown match_mode %q, expected %q", args[0], matchModeNamePrefix)
+				}
+				k8sCross.MatchMode = args[0]
+			case "tag_template":
+				// Overrides the Go template used to compute a service's
+				// Headscale ACL tag in tag-based match mode (see serviceTag).
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, fmt.Errorf("tag_template requires exactly one argument")
+				}
+				tmpl, err := parseTagTemplate(args[0])
+				if err != nil {
+					return nil, fmt.Errorf("invalid tag_template: %w", err)
+				}
+				k8sCross.TagTemplate = args[0]
+				k8sCross.tagTmpl = tmpl
+			case "srv_port":
+				// Overrides the port/proto/name buildSRVRecords advertises
+				// for one service on the plain-Headscale matching path
+				// (the MCS path already gets real ports from EndpointSlices).
+				args := c.RemainingArgs()
+				if len(args) < 2 || len(args) > 4 {
+					return nil, fmt.Errorf("srv_port requires <namespace>/<service> <port> [proto] [name]")
+				}
+				namespace, service, ok := strings.Cut(args[0], "/")
+				if !ok || namespace == "" || service == "" {
+					return nil, fmt.Errorf("invalid srv_port service %q, expected <namespace>/<service>", args[0])
+				}
+				port, err := strconv.ParseUint(args[1], 10, 16)
+				if err != nil {
+					return nil, fmt.Errorf("invalid srv_port port %q: %w", args[1], err)
+				}
+				entry := srvPort{Port: uint16(port), Proto: defaultSRVPort.Proto, Name: defaultSRVPort.Name}
+				if len(args) >= 3 {
+					entry.Proto = args[2]
+				}
+				if len(args) == 4 {
+					entry.Name = args[3]
+				}
+				if k8sCross.SRVPorts == nil {
+					k8sCross.SRVPorts = make(map[string]srvPort)
+				}
+				k8sCross.SRVPorts[srvPortKey(namespace, service)] = entry
+			case "kubeconfig":
+				// Build an MCS controller from an explicit kubeconfig file and,
+				// optionally, a context name within it.
+				args := c.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return nil, fmt.Errorf("kubeconfig requires a path and an optional context")
+				}
+				overrides := &clientcmd.ConfigOverrides{}
+				if len(args) == 2 {
+					overrides.CurrentContext = args[1]
+				}
+				loader := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+					&clientcmd.ClientConfigLoadingRules{ExplicitPath: args[0]},
+					overrides,
+				)
+				config, err := loader.ClientConfig()
+				if err != nil {
+					return nil, fmt.Errorf("loading kubeconfig %s: %w", args[0], err)
+				}
+				controller, err := mcs.NewController(config)
+				if err != nil {
+					return nil, fmt.Errorf("building mcs controller: %w", err)
+				}
+				k8sCross.mcsController = controller
 			default:
 				return nil, fmt.Errorf("unknown property '%s'", c.Val())
 			}
@@ -110,6 +474,14 @@ func parseConfig(c *caddy.Controller) (*K8sCross, error) {
 	if k8sCross.HeadscaleClient == nil {
 		return nil, fmt.Errorf("headscale_url is required configuration for k8s_cross plugin")
 	}
+	if len(k8sCross.ReverseZones) > 0 && k8sCross.mcsController == nil {
+		// rebuildReverseIndex has no way to populate reverseIdx without an
+		// MCS controller to enumerate services from (see isReverseQuery), so
+		// `reverse` would otherwise silently configure a zone that never
+		// resolves. Fail fast instead of letting an operator discover this
+		// at query time.
+		return nil, fmt.Errorf("reverse requires incluster or kubeconfig to be configured")
+	}
 
 	return k8sCross, nil
 }
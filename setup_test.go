@@ -1,6 +1,9 @@
 package k8s_cross
 
 import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/coredns/caddy"
@@ -45,6 +48,31 @@ func TestParseConfig(t *testing.T) {
 			input: `k8s_cross {
     headscale_url http://headscale:8080 api-key-123
     ttl invalid
+}`,
+			expectError: true,
+		},
+		{
+			name: "valid tag_template",
+			input: `k8s_cross {
+    headscale_url http://headscale:8080 api-key-123
+    tag_template tag:svc-{{.Service}}
+}`,
+			expectError:   false,
+			expectedZones: []string{"."},
+		},
+		{
+			name: "invalid tag_template",
+			input: `k8s_cross {
+    headscale_url http://headscale:8080 api-key-123
+    tag_template tag:svc-{{.Service
+}`,
+			expectError: true,
+		},
+		{
+			name: "reverse without mcs controller",
+			input: `k8s_cross {
+    headscale_url http://headscale:8080 api-key-123
+    reverse 10.0.0.0/8
 }`,
 			expectError: true,
 		},
@@ -82,4 +110,29 @@ func TestParseConfig(t *testing.T) {
 			}
 		})
 	}
+}
+
+// TestNamespaceFromServiceAccountToken tests decoding the namespace claim out
+// of an (unverified) service account JWT.
+func TestNamespaceFromServiceAccountToken(t *testing.T) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"kubernetes.io/serviceaccount/namespace":"my-namespace"}`))
+	token := header + "." + payload + ".signature"
+
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte(token), 0o600); err != nil {
+		t.Fatalf("writing fake token: %v", err)
+	}
+
+	ns, err := namespaceFromServiceAccountToken(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ns != "my-namespace" {
+		t.Errorf("expected namespace 'my-namespace', got '%s'", ns)
+	}
+
+	if _, err := namespaceFromServiceAccountToken(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected error for missing token file, got none")
+	}
 }
\ No newline at end of file